@@ -0,0 +1,223 @@
+package gorient
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A MissingFieldError is returned by Lookup and the typed accessors when
+// a field doesn't exist.
+type MissingFieldError struct {
+	Path string
+}
+
+func (e *MissingFieldError) Error() string {
+	return "gorient: no field " + e.Path
+}
+
+// A FieldTypeError is returned by Lookup and the typed accessors when a
+// field's value isn't of the type asked for.
+type FieldTypeError struct {
+	Path  string
+	Value interface{}
+	Want  string
+}
+
+func (e *FieldTypeError) Error() string {
+	return fmt.Sprintf("gorient: field %s is %s, not %s", e.Path, valueName(e.Value), e.Want)
+}
+
+// Lookup returns the value at path, a dot separated list of field names
+// leading through embedded documents and maps, eg. "address.city".  At
+// each level a field (or map key) whose name contains dots is preferred
+// to descending, so "rules.database.command" finds the "database.command"
+// key of the "rules" map.  A nil *Document, as d or along the way, has
+// no fields.
+func (d *Document) Lookup(path string) (interface{}, error) {
+	var v interface{} = d
+	rest := path
+	for {
+		var m map[string]interface{}
+		switch c := v.(type) {
+		case *Document:
+			if c != nil { // a nil document has no fields
+				m = c.Fields
+			}
+		case map[string]interface{}:
+			m = c
+		default:
+			at := path[:len(path)-len(rest)-1]
+			return nil, &FieldTypeError{at, v, "a document or map"}
+		}
+
+		if x, ok := m[rest]; ok {
+			return x, nil
+		}
+		i := strings.IndexByte(rest, '.')
+		if i < 0 {
+			return nil, &MissingFieldError{path}
+		}
+		x, ok := m[rest[:i]]
+		if !ok {
+			return nil, &MissingFieldError{path[:len(path)-len(rest)+i]}
+		}
+		v, rest = x, rest[i+1:]
+	}
+}
+
+// GetString returns the string at path.
+func (d *Document) GetString(path string) (string, error) {
+	v, err := d.Lookup(path)
+	if err != nil {
+		return "", err
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", &FieldTypeError{path, v, "string"}
+	}
+	return s, nil
+}
+
+// GetBool returns the boolean at path.
+func (d *Document) GetBool(path string) (bool, error) {
+	v, err := d.Lookup(path)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, &FieldTypeError{path, v, "bool"}
+	}
+	return b, nil
+}
+
+// GetInt64 returns the integer at path, which may be a byte, short, int
+// or long.  Bytes are signed, as they are on the server.
+func (d *Document) GetInt64(path string) (int64, error) {
+	v, err := d.Lookup(path)
+	if err != nil {
+		return 0, err
+	}
+	switch n := v.(type) {
+	case byte:
+		return int64(int8(n)), nil
+	case int16:
+		return int64(n), nil
+	case int32:
+		return int64(n), nil
+	case int64:
+		return n, nil
+	}
+	return 0, &FieldTypeError{path, v, "an integer"}
+}
+
+// GetFloat64 returns the float or double at path.
+func (d *Document) GetFloat64(path string) (float64, error) {
+	v, err := d.Lookup(path)
+	if err != nil {
+		return 0, err
+	}
+	switch f := v.(type) {
+	case float32:
+		return float64(f), nil
+	case float64:
+		return f, nil
+	}
+	return 0, &FieldTypeError{path, v, "a float"}
+}
+
+// GetDecimal returns the BigDecimal at path.
+func (d *Document) GetDecimal(path string) (Decimal, error) {
+	v, err := d.Lookup(path)
+	if err != nil {
+		return Decimal{}, err
+	}
+	dec, ok := v.(Decimal)
+	if !ok {
+		return Decimal{}, &FieldTypeError{path, v, "a decimal"}
+	}
+	return dec, nil
+}
+
+// GetTime returns the date or datetime at path.
+func (d *Document) GetTime(path string) (time.Time, error) {
+	v, err := d.Lookup(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	switch t := v.(type) {
+	case time.Time:
+		return t, nil
+	case Date:
+		return t.Time, nil
+	}
+	return time.Time{}, &FieldTypeError{path, v, "a time"}
+}
+
+// GetBytes returns the binary value at path.
+func (d *Document) GetBytes(path string) ([]byte, error) {
+	v, err := d.Lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := v.([]byte)
+	if !ok {
+		return nil, &FieldTypeError{path, v, "binary"}
+	}
+	return b, nil
+}
+
+// GetRid returns the link at path.
+func (d *Document) GetRid(path string) (Rid, error) {
+	v, err := d.Lookup(path)
+	if err != nil {
+		return Rid{}, err
+	}
+	id, ok := v.(Rid)
+	if !ok {
+		return Rid{}, &FieldTypeError{path, v, "a rid"}
+	}
+	return id, nil
+}
+
+// GetDocument returns the embedded document at path.
+func (d *Document) GetDocument(path string) (*Document, error) {
+	v, err := d.Lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	doc, ok := v.(*Document)
+	if !ok {
+		return nil, &FieldTypeError{path, v, "a document"}
+	}
+	return doc, nil
+}
+
+// GetMap returns the embedded map at path.
+func (d *Document) GetMap(path string) (map[string]interface{}, error) {
+	v, err := d.Lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, &FieldTypeError{path, v, "a map"}
+	}
+	return m, nil
+}
+
+// GetList returns the elements of the list or set at path.
+func (d *Document) GetList(path string) ([]interface{}, error) {
+	v, err := d.Lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	switch l := v.(type) {
+	case []interface{}:
+		return l, nil
+	case Set:
+		return l, nil
+	}
+	return nil, &FieldTypeError{path, v, "a list"}
+}
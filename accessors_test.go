@@ -0,0 +1,112 @@
+package gorient
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAccessors(t *testing.T) {
+	d := parse(`Profile@nick:"Neo",b:-12b,s:7s,i:51,l:9000000000l,f:1.5f,ok:true,born:1306281600000a,` +
+		`loc:#3:2,data:_aGk=_,tags:<"a","b">,friends:[#10:5],none:,` +
+		`address:(Address@street:"Main",geo:{"lat":1.5d,"zip.code":"0101"}),` + testrec[len("ORole@"):])
+
+	if s, err := d.GetString("nick"); s != "Neo" || err != nil {
+		t.Errorf("GetString = %q, %v", s, err)
+	}
+	for path, want := range map[string]int64{"b": -12, "s": 7, "i": 51, "l": 9000000000, "rules.short": 245} {
+		if n, err := d.GetInt64(path); n != want || err != nil {
+			t.Errorf("GetInt64(%s) = %d, %v", path, n, err)
+		}
+	}
+	if f, err := d.GetFloat64("f"); f != 1.5 || err != nil {
+		t.Errorf("GetFloat64 = %v, %v", f, err)
+	}
+	if f, err := d.GetFloat64("address.geo.lat"); f != 1.5 || err != nil {
+		t.Errorf("GetFloat64(address.geo.lat) = %v, %v", f, err)
+	}
+	if b, err := d.GetBool("ok"); !b || err != nil {
+		t.Errorf("GetBool = %v, %v", b, err)
+	}
+	if tm, err := d.GetTime("born"); !tm.Equal(time.Date(2011, 5, 25, 0, 0, 0, 0, time.UTC)) || err != nil {
+		t.Errorf("GetTime = %v, %v", tm, err)
+	}
+	if id, err := d.GetRid("loc"); id != (Rid{3, 2}) || err != nil {
+		t.Errorf("GetRid = %v, %v", id, err)
+	}
+	if b, err := d.GetBytes("data"); string(b) != "hi" || err != nil {
+		t.Errorf("GetBytes = %v, %v", b, err)
+	}
+	if l, err := d.GetList("tags"); len(l) != 2 || err != nil {
+		t.Errorf("GetList(tags) = %v, %v", l, err)
+	}
+	if l, err := d.GetList("friends"); len(l) != 1 || l[0] != (Rid{10, 5}) || err != nil {
+		t.Errorf("GetList(friends) = %v, %v", l, err)
+	}
+	if a, err := d.GetDocument("address"); err != nil || a.Class != "Address" {
+		t.Errorf("GetDocument = %v, %v", a, err)
+	}
+	if m, err := d.GetMap("rules"); len(m) != 13 || err != nil {
+		t.Errorf("GetMap = %v, %v", m, err)
+	}
+	if dec, err := d.GetDecimal("rules.big"); dec.String() != "0.58595884848484" || err != nil {
+		t.Errorf("GetDecimal = %v, %v", dec, err)
+	}
+
+	// Keys containing dots win over descending.
+	if s, err := d.GetString("address.geo.zip.code"); s != "0101" || err != nil {
+		t.Errorf("GetString(address.geo.zip.code) = %q, %v", s, err)
+	}
+	if n, err := d.GetInt64("rules.database.command"); n != 2 || err != nil {
+		t.Errorf("GetInt64(rules.database.command) = %d, %v", n, err)
+	}
+	if v, err := d.Lookup("none"); v != nil || err != nil {
+		t.Errorf("Lookup(none) = %v, %v", v, err)
+	}
+}
+
+func TestAccessorErrors(t *testing.T) {
+	d := parse(`name:"Neo",age:30,none:,address:(city:"Zion")`)
+
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{second(d.GetInt64("name")), "gorient: field name is string, not an integer"},
+		{second(d.GetString("age")), "gorient: field age is int32, not string"},
+		{second(d.GetString("none")), "gorient: field none is null, not string"},
+		{second(d.GetTime("address")), "gorient: field address is document, not a time"},
+		{second(d.GetString("address.city.x")), "gorient: field address.city is string, not a document or map"},
+		{second(d.GetString("nick")), "gorient: no field nick"},
+		{second(d.GetString("address.street")), "gorient: no field address.street"},
+		{second(d.GetString("office.city")), "gorient: no field office"},
+	}
+	for _, tt := range tests {
+		if tt.err == nil || tt.err.Error() != tt.want {
+			t.Errorf("got %v, want %q", tt.err, tt.want)
+		}
+	}
+	var nilDoc *Document
+	d.Fields["office"] = nilDoc
+	for _, tt := range []struct {
+		d    *Document
+		path string
+		want string
+	}{
+		{nilDoc, "nick", "gorient: no field nick"},
+		{nilDoc, "address.city", "gorient: no field address"},
+		{d, "office.city", "gorient: no field office.city"},
+	} {
+		if _, err := tt.d.GetString(tt.path); err == nil || err.Error() != tt.want {
+			t.Errorf("GetString(%s) through nil document: got %v, want %q", tt.path, err, tt.want)
+		}
+	}
+	if _, err := d.GetRid("age"); err == nil {
+		t.Error("GetRid: expected error")
+	} else if e, ok := err.(*FieldTypeError); !ok || e.Path != "age" || e.Value != int32(30) {
+		t.Errorf("GetRid: got %#v", err)
+	}
+}
+
+func second(_ interface{}, err error) error {
+	return err
+}
@@ -0,0 +1,697 @@
+package gorient
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/big"
+	r "reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// The binary record format (ORecordSerializerBinary, version 0) is an
+// alternative to the record string format, negotiated when a database
+// is opened with protocol 22 or later.  A document is
+//
+//	(version:byte)(class:string)(header)(values)
+//
+// where the header lists the fields,
+//
+//	[(name:string)(pointer:int32)(type:byte)]* (0:varint)
+//
+// each pointer giving the offset, from the start of the record, of the
+// field's value (0 for null).  Embedded documents are written the same
+// way without the version byte, their pointers still counting from the
+// start of the outermost record.  Strings and byte arrays are a varint
+// length followed by the bytes; integers are zig-zag varints.
+
+// Value types (OType ids)
+const (
+	binBoolean      = 0
+	binInteger      = 1
+	binShort        = 2
+	binLong         = 3
+	binFloat        = 4
+	binDouble       = 5
+	binDatetime     = 6
+	binString       = 7
+	binBinary       = 8
+	binEmbedded     = 9
+	binEmbeddedList = 10
+	binEmbeddedSet  = 11
+	binEmbeddedMap  = 12
+	binLink         = 13
+	binLinkList     = 14
+	binLinkSet      = 15
+	binLinkMap      = 16
+	binByte         = 17
+	binDate         = 19
+	binDecimal      = 21
+	binLinkBag      = 22
+	binAny          = 23
+
+	binNull = 0xff // -1: the type of a null collection item
+)
+
+const binaryVersion = 0
+
+const msPerDay = 24 * 60 * 60 * 1000
+
+// MarshalBinary returns the binary record format encoding of v, a
+// *Document or a struct, as described for Marshal.
+//
+// Go types map to the same field types as in the record string format,
+// except that a slice (or Set) holding only Rids is written as a list
+// (or set) of links.
+func MarshalBinary(v interface{}) ([]byte, error) {
+	return MarshalBinaryInLocation(v, nil)
+}
+
+// MarshalBinaryInLocation is MarshalBinary with the calendar day of a
+// date-tagged time.Time taken as for MarshalInLocation.  A nil loc
+// means UTC.
+func MarshalBinaryInLocation(v interface{}, loc *time.Location) (b []byte, err error) {
+	defer func() {
+		if x := recover(); x != nil {
+			if ee, ok := x.(encodeError); ok {
+				err = ee.error
+			} else {
+				panic(x)
+			}
+		}
+	}()
+	rv := r.ValueOf(v)
+	for rv.Kind() == r.Ptr || rv.Kind() == r.Interface {
+		if rv.IsNil() {
+			return nil, &UnsupportedValueError{rv, "nil document"}
+		}
+		rv = rv.Elem()
+	}
+	if !isDocument(rv.Type()) {
+		return nil, &UnsupportedTypeError{rv.Type()}
+	}
+	e := &binEncoder{buf: make([]byte, 1, 128), loc: loc}
+	e.buf[0] = binaryVersion
+	e.document(rv)
+	return e.buf, nil
+}
+
+// UnmarshalBinary decodes a document in the binary record format and
+// stores it in the value pointed to by v, as Unmarshal does.
+func UnmarshalBinary(data []byte, v interface{}) error {
+	return UnmarshalBinaryInLocation(data, v, nil)
+}
+
+// UnmarshalBinaryInLocation is UnmarshalBinary with dates and datetimes
+// in loc, as for UnmarshalInLocation.  A nil loc means UTC.
+func UnmarshalBinaryInLocation(data []byte, v interface{}, loc *time.Location) error {
+	rv := r.ValueOf(v)
+	if rv.Kind() != r.Ptr || rv.IsNil() {
+		return &InvalidUnmarshalError{r.TypeOf(v)}
+	}
+	return unmarshal(decodeBinary, data, rv, nil, loc)
+}
+
+type binEncoder struct {
+	buf     []byte
+	scratch [binary.MaxVarintLen64]byte
+	loc     *time.Location // for dates; nil means UTC
+	depth   int            // of value calls, to catch cycles
+}
+
+func (e *binEncoder) error(err error) {
+	panic(encodeError{err})
+}
+
+func (e *binEncoder) varint(n int64) {
+	e.buf = append(e.buf, e.scratch[:binary.PutVarint(e.scratch[:], n)]...)
+}
+
+func (e *binEncoder) bytes(b []byte) {
+	e.varint(int64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *binEncoder) string(s string) {
+	e.varint(int64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *binEncoder) int32(n int32) {
+	binary.BigEndian.PutUint32(e.scratch[:], uint32(n))
+	e.buf = append(e.buf, e.scratch[:4]...)
+}
+
+func (e *binEncoder) int64(n int64) {
+	binary.BigEndian.PutUint64(e.scratch[:], uint64(n))
+	e.buf = append(e.buf, e.scratch[:8]...)
+}
+
+// pointer reserves space for a pointer, to be set once the value it
+// points to is written.
+func (e *binEncoder) pointer() int {
+	e.buf = append(e.buf, 0, 0, 0, 0)
+	return len(e.buf) - 4
+}
+
+func (e *binEncoder) setPointer(at int) {
+	binary.BigEndian.PutUint32(e.buf[at:], uint32(len(e.buf)))
+}
+
+// binField is a field or map entry waiting for its value to be written.
+type binField struct {
+	ptr  int
+	typ  byte
+	v    r.Value
+	date bool
+}
+
+// document writes the class, header and values of the Document or
+// struct v.
+func (e *binEncoder) document(v r.Value) {
+	var fields []binField
+	header := func(name string, fv r.Value, date bool) {
+		e.string(name)
+		f := binField{ptr: e.pointer(), typ: binNull, date: date}
+		if fv = deref(fv); fv.IsValid() {
+			f.typ, f.v = e.typeOf(fv, date), fv
+		}
+		e.buf = append(e.buf, f.typ)
+		fields = append(fields, f)
+	}
+
+	if v.Type() == documentType {
+		d := v.Interface().(Document)
+		e.string(d.Class)
+		for _, k := range d.Names() {
+			header(k, r.ValueOf(d.Fields[k]), false)
+		}
+	} else {
+		si := cachedStructInfo(v.Type())
+		class := ""
+		if si.class >= 0 {
+			class = v.Field(si.class).String()
+		}
+		e.string(class)
+		for _, f := range si.fields {
+			fv := v.Field(f.index)
+			if f.omitEmpty && isEmptyValue(fv) {
+				continue
+			}
+			header(f.name, fv, f.date)
+		}
+	}
+	e.varint(0)
+	e.values(fields)
+}
+
+// values writes the values of fields, setting their pointers.
+func (e *binEncoder) values(fields []binField) {
+	for _, f := range fields {
+		if f.typ == binNull {
+			continue
+		}
+		e.setPointer(f.ptr)
+		e.value(f.typ, f.v, f.date)
+	}
+}
+
+// deref follows pointers and interfaces, returning the zero Value for
+// nil.
+func deref(v r.Value) r.Value {
+	for v.Kind() == r.Ptr || v.Kind() == r.Interface {
+		if v.IsNil() {
+			return r.Value{}
+		}
+		v = v.Elem()
+	}
+	return v
+}
+
+// typeOf returns the type v (not nil) is written as.
+func (e *binEncoder) typeOf(v r.Value, date bool) byte {
+	switch v.Kind() {
+	case r.Bool:
+		return binBoolean
+	case r.Int8, r.Uint8:
+		return binByte
+	case r.Int16:
+		return binShort
+	case r.Int32, r.Uint16:
+		return binInteger
+	case r.Int, r.Int64, r.Uint, r.Uint32, r.Uint64:
+		return binLong
+	case r.Float32:
+		return binFloat
+	case r.Float64:
+		return binDouble
+	case r.String:
+		return binString
+	case r.Map:
+		if v.Type().Key().Kind() != r.String {
+			e.error(&UnsupportedTypeError{v.Type()})
+		}
+		return binEmbeddedMap
+	case r.Slice, r.Array:
+		if v.Kind() == r.Slice && v.Type().Elem().Kind() == r.Uint8 {
+			return binBinary
+		}
+		set := v.Type() == setType
+		if allRids(v) {
+			if set {
+				return binLinkSet
+			}
+			return binLinkList
+		}
+		if set {
+			return binEmbeddedSet
+		}
+		return binEmbeddedList
+	case r.Struct:
+		switch v.Type() {
+		case ridType:
+			return binLink
+		case decimalType, ratType:
+			return binDecimal
+		case timeType:
+			if date {
+				return binDate
+			}
+			return binDatetime
+		case dateType:
+			return binDate
+		}
+		return binEmbedded
+	}
+	e.error(&UnsupportedTypeError{v.Type()})
+	return 0
+}
+
+// allRids reports whether the slice v is non-empty and holds only Rids.
+func allRids(v r.Value) bool {
+	n := v.Len()
+	for i := 0; i < n; i++ {
+		if e := deref(v.Index(i)); !e.IsValid() || e.Type() != ridType {
+			return false
+		}
+	}
+	return n > 0
+}
+
+// value writes v as type typ.
+func (e *binEncoder) value(typ byte, v r.Value, date bool) {
+	if e.depth++; e.depth > maxDepth {
+		e.error(&UnsupportedValueError{v, "value nested too deeply, or cyclic"})
+	}
+	defer func() { e.depth-- }()
+
+	switch typ {
+	case binBoolean:
+		if v.Bool() {
+			e.buf = append(e.buf, 1)
+		} else {
+			e.buf = append(e.buf, 0)
+		}
+	case binByte:
+		if v.Kind() == r.Uint8 {
+			e.buf = append(e.buf, byte(v.Uint()))
+		} else {
+			e.buf = append(e.buf, byte(v.Int()))
+		}
+	case binShort, binInteger, binLong:
+		if isUint(v.Kind()) {
+			if v.Uint() > math.MaxInt64 {
+				e.error(&UnsupportedValueError{v, strconv.FormatUint(v.Uint(), 10)})
+			}
+			e.varint(int64(v.Uint()))
+		} else {
+			e.varint(v.Int())
+		}
+	case binFloat:
+		e.int32(int32(math.Float32bits(float32(v.Float()))))
+	case binDouble:
+		e.int64(int64(math.Float64bits(v.Float())))
+	case binString:
+		e.string(v.String())
+	case binBinary:
+		e.bytes(v.Bytes())
+	case binDatetime:
+		e.varint(timeMs(v.Interface().(time.Time)))
+	case binDate:
+		// The server stores the calendar day as days since the epoch
+		// in UTC.
+		t, ok := v.Interface().(time.Time)
+		if !ok {
+			t = v.Interface().(Date).Time
+		}
+		y, m, d := dateOf(t, e.loc).Date()
+		e.varint(time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Unix() * 1000 / msPerDay)
+	case binDecimal:
+		d, err := decimalValue(v)
+		if err != nil {
+			e.error(err)
+		}
+		b := twosComplement(d.Unscaled())
+		e.int32(d.Scale())
+		e.int32(int32(len(b)))
+		e.buf = append(e.buf, b...)
+	case binLink:
+		e.link(v.Interface().(Rid))
+	case binLinkList, binLinkSet:
+		n := v.Len()
+		e.varint(int64(n))
+		for i := 0; i < n; i++ {
+			e.link(deref(v.Index(i)).Interface().(Rid))
+		}
+	case binEmbeddedList, binEmbeddedSet:
+		n := v.Len()
+		e.varint(int64(n))
+		e.buf = append(e.buf, binAny)
+		for i := 0; i < n; i++ {
+			ev := deref(v.Index(i))
+			if !ev.IsValid() {
+				e.buf = append(e.buf, binNull)
+				continue
+			}
+			t := e.typeOf(ev, false)
+			e.buf = append(e.buf, t)
+			e.value(t, ev, false)
+		}
+	case binEmbeddedMap:
+		e.embeddedMap(v)
+	case binEmbedded:
+		e.document(v)
+	}
+}
+
+func (e *binEncoder) link(rid Rid) {
+	e.varint(int64(rid.Cluster))
+	e.varint(rid.Position)
+}
+
+// embeddedMap writes a map as its size, a header of keys like a
+// document's, and the values.
+func (e *binEncoder) embeddedMap(v r.Value) {
+	keys := make([]string, 0, v.Len())
+	for _, k := range v.MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+	e.varint(int64(len(keys)))
+	entries := make([]binField, len(keys))
+	for i, k := range keys {
+		e.buf = append(e.buf, binString)
+		e.string(k)
+		f := binField{ptr: e.pointer(), typ: binNull}
+		if ev := deref(v.MapIndex(r.ValueOf(k).Convert(v.Type().Key()))); ev.IsValid() {
+			f.typ, f.v = e.typeOf(ev, false), ev
+		}
+		e.buf = append(e.buf, f.typ)
+		entries[i] = f
+	}
+	e.values(entries)
+}
+
+// twosComplement returns the big-endian two's complement form of n, as
+// Java's BigInteger.toByteArray does.
+func twosComplement(n *big.Int) []byte {
+	if n.Sign() >= 0 {
+		b := n.Bytes()
+		if len(b) == 0 || b[0]&0x80 != 0 {
+			b = append([]byte{0}, b...)
+		}
+		return b
+	}
+	// -n = ^(n-1): complement the bytes of |n|-1.
+	m := new(big.Int).Sub(new(big.Int).Neg(n), big.NewInt(1))
+	b := m.Bytes()
+	if len(b) == 0 || b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	for i := range b {
+		b[i] = ^b[i]
+	}
+	return b
+}
+
+// fromTwosComplement is the inverse of twosComplement.
+func fromTwosComplement(b []byte) *big.Int {
+	n := new(big.Int).SetBytes(b)
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		n.Sub(n, new(big.Int).Lsh(big.NewInt(1), uint(len(b))*8))
+	}
+	return n
+}
+
+// decodeBinary decodes the binary format document in b into d, or a new
+// Document if d is nil, as decode does for the record string format.
+func decodeBinary(b []byte, d *Document, names nameCache, loc *time.Location) (doc *Document, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			if _, ok := e.(runtime.Error); ok {
+				panic(e)
+			}
+			err = e.(error)
+		}
+	}()
+	dec := &binDecoder{b: b, names: names, loc: loc}
+	if v := dec.byte(); v != binaryVersion {
+		dec.errorf("unsupported binary format version %d", v)
+	}
+	return dec.document(d), nil
+}
+
+type binDecoder struct {
+	b     []byte
+	off   int
+	end   int // the furthest offset read, for embedded documents
+	names nameCache
+	loc   *time.Location
+}
+
+func (d *binDecoder) errorf(format string, args ...interface{}) {
+	panic(newSyntaxError(d.b, d.off, nil, []byte(fmt.Sprintf(format, args...))))
+}
+
+// need checks n more bytes are available.
+func (d *binDecoder) need(n int) {
+	if n < 0 || len(d.b)-d.off < n {
+		d.errorf("unexpected end of record")
+	}
+}
+
+func (d *binDecoder) seek(off int) {
+	if off > d.end {
+		d.end = off
+	}
+	d.off = off
+}
+
+func (d *binDecoder) byte() byte {
+	d.need(1)
+	d.off++
+	return d.b[d.off-1]
+}
+
+func (d *binDecoder) varint() int64 {
+	n, l := binary.Varint(d.b[d.off:])
+	if l <= 0 {
+		d.errorf("bad varint")
+	}
+	d.off += l
+	return n
+}
+
+func (d *binDecoder) int32() int32 {
+	d.need(4)
+	d.off += 4
+	return int32(binary.BigEndian.Uint32(d.b[d.off-4:]))
+}
+
+func (d *binDecoder) raw(n int) []byte {
+	d.need(n)
+	d.off += n
+	return d.b[d.off-n : d.off]
+}
+
+func (d *binDecoder) bytes() []byte {
+	return d.raw(int(d.varint()))
+}
+
+func (d *binDecoder) name() string {
+	return d.names.intern(d.bytes())
+}
+
+func (d *binDecoder) link() Rid {
+	return Rid{int16(d.varint()), d.varint()}
+}
+
+// document decodes a document's class, header and values into out, or
+// a new Document if out is nil, leaving the offset after its values.
+func (d *binDecoder) document(out *Document) *Document {
+	if out == nil {
+		out = &Document{
+			Fields: make(map[string]interface{}, 8),
+			order:  make([]string, 0, 8),
+		}
+	} else {
+		out.Reset()
+	}
+	out.Class = d.name()
+
+	type entry struct {
+		name string
+		ptr  int32
+		typ  byte
+	}
+	var entries []entry
+	for {
+		n := d.varint()
+		if n == 0 {
+			break
+		}
+		if n < 0 {
+			// A property id, whose name and type are in the schema.
+			d.errorf("schema property %d not supported", -n-1)
+		}
+		name := d.names.intern(d.raw(int(n)))
+		entries = append(entries, entry{name, d.int32(), d.byte()})
+	}
+	d.values(len(entries), func(i int) (int32, byte) { return entries[i].ptr, entries[i].typ },
+		func(i int, v interface{}) { out.Set(entries[i].name, v) })
+	return out
+}
+
+// values decodes n values, given the pointer and type of each, leaving
+// the offset after the last byte read.
+func (d *binDecoder) values(n int, at func(int) (int32, byte), set func(int, interface{})) {
+	d.seek(d.off)
+	for i := 0; i < n; i++ {
+		ptr, typ := at(i)
+		if ptr == 0 {
+			set(i, nil)
+			continue
+		}
+		if ptr < 0 || int(ptr) > len(d.b) {
+			d.errorf("bad pointer %d", ptr)
+		}
+		d.seek(int(ptr))
+		set(i, d.value(typ))
+		d.seek(d.off)
+	}
+	d.off = d.end
+}
+
+// value decodes a value of type typ, as the record string parser would
+// return it.
+func (d *binDecoder) value(typ byte) interface{} {
+	switch typ {
+	case binBoolean:
+		return d.byte() != 0
+	case binByte:
+		return d.byte()
+	case binShort:
+		return int16(d.varint())
+	case binInteger:
+		return int32(d.varint())
+	case binLong:
+		return d.varint()
+	case binFloat:
+		return math.Float32frombits(uint32(d.int32()))
+	case binDouble:
+		return math.Float64frombits(binary.BigEndian.Uint64(d.raw(8)))
+	case binDatetime:
+		return msTime(d.varint(), d.loc)
+	case binDate:
+		return Date{dateOf(time.Unix(d.varint()*msPerDay/1000, 0).UTC(), d.loc)}
+	case binString:
+		return string(d.bytes())
+	case binBinary:
+		return append([]byte(nil), d.bytes()...)
+	case binDecimal:
+		scale := d.int32()
+		n := d.int32()
+		return Decimal{fromTwosComplement(d.raw(int(n))), scale}
+	case binLink:
+		return d.link()
+	case binLinkList, binLinkSet:
+		n := int(d.varint())
+		d.need(n)
+		l := make([]interface{}, n)
+		for i := range l {
+			l[i] = d.link()
+		}
+		if typ == binLinkSet {
+			return Set(l)
+		}
+		return l
+	case binLinkMap:
+		n := int(d.varint())
+		d.need(n)
+		m := make(map[string]interface{}, n)
+		for i := 0; i < n; i++ {
+			d.byte() // key type, always string
+			k := d.name()
+			m[k] = d.link()
+		}
+		return m
+	case binEmbeddedList, binEmbeddedSet:
+		n := int(d.varint())
+		d.need(n)
+		d.byte() // type of the items, always "any"
+		l := make([]interface{}, n)
+		for i := range l {
+			if t := d.byte(); t != binNull {
+				l[i] = d.value(t)
+			}
+		}
+		if typ == binEmbeddedSet {
+			return Set(l)
+		}
+		return l
+	case binEmbeddedMap:
+		n := int(d.varint())
+		d.need(n)
+		keys := make([]string, n)
+		ptrs := make([]int32, n)
+		types := make([]byte, n)
+		for i := range keys {
+			d.byte() // key type, always string
+			keys[i], ptrs[i], types[i] = d.name(), d.int32(), d.byte()
+		}
+		m := make(map[string]interface{}, n)
+		d.values(n, func(i int) (int32, byte) { return ptrs[i], types[i] },
+			func(i int, v interface{}) { m[keys[i]] = v })
+		return m
+	case binEmbedded:
+		return d.document(nil)
+	case binLinkBag:
+		return d.linkBag()
+	}
+	d.errorf("unsupported value type %d", typ)
+	return nil
+}
+
+// linkBag decodes an embedded link bag (RidBag) as a Set of Rids.  A
+// bag kept in a separate tree on the server can't be read here.
+func (d *binDecoder) linkBag() interface{} {
+	conf := d.byte()
+	if conf&2 != 0 {
+		d.raw(16) // uuid
+	}
+	if conf&1 == 0 {
+		d.errorf("tree link bags not supported")
+	}
+	n := int(d.int32())
+	d.need(n)
+	s := make(Set, n)
+	for i := range s {
+		c := int16(binary.BigEndian.Uint16(d.raw(2)))
+		p := int64(binary.BigEndian.Uint64(d.raw(8)))
+		s[i] = Rid{c, p}
+	}
+	return s
+}
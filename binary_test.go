@@ -0,0 +1,248 @@
+package gorient
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math"
+	"math/big"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// The binary format decodes to the same values as the record string
+// format.
+func TestBinaryMatchesCSV(t *testing.T) {
+	csv := `Profile@s:"x\"y",t:true,b:-12b,sh:3s,i:42,l:5000000000l,f:1.5f,d:2.5d,` +
+		`c:-1.50c,dt:1296279468123t,da:1296172800000a,bin:_AAEC_,rid:#9:1,none:,` +
+		`list:[1,"two",null,[3],(Dog@name:"Rex")],set:<1,2>,` +
+		`links:[#9:1,#9:2],linkset:<#10:0>,m:{"k":1,"n":null,"doc":(n:1)},` +
+		`dog:(Dog@name:"Fido",tags:["a"]),empty:[]`
+	want, err := decode([]byte(csv), nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := MarshalBinary(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodeBinary(b, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got  %v\nwant %v", got, want)
+	}
+	if s := got.Fields["links"]; reflect.TypeOf(s) != reflect.TypeOf([]interface{}{}) {
+		t.Errorf("links: got %T", s)
+	}
+
+	// Decoding into a Document reuses it.
+	d := NewDocument("Other")
+	d.Set("x", 1)
+	if err := UnmarshalBinary(b, d); err != nil || !reflect.DeepEqual(d, want) {
+		t.Errorf("UnmarshalBinary into Document: got %v, %v", d, err)
+	}
+}
+
+// A record encoded independently of this package.
+func TestBinaryFixture(t *testing.T) {
+	b, _ := hex.DecodeString("000c416e696d616c086e616d650000001c0706616765000000210100084669646f06")
+	d, err := decodeBinary(b, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Class != "Animal" || d.Fields["name"] != "Fido" || d.Fields["age"] != int32(3) ||
+		!reflect.DeepEqual(d.order, []string{"name", "age"}) {
+		t.Errorf("got %v", d)
+	}
+	if enc, err := MarshalBinary(d); err != nil || !bytes.Equal(enc, b) {
+		t.Errorf("MarshalBinary: got %x, %v", enc, err)
+	}
+}
+
+func TestBinaryStruct(t *testing.T) {
+	type event struct {
+		Class string    `orient:"@class"`
+		Name  string    `orient:"name"`
+		Day   time.Time `orient:"day,date"`
+		At    time.Time `orient:"at"`
+		Cost  Decimal   `orient:"cost"`
+		Dog   *animal   `orient:"dog"`
+		Skip  string    `orient:"skip,omitempty"`
+	}
+	at := time.Date(2013, 5, 6, 7, 8, 9, 10e6, time.UTC)
+	cost, _ := ParseDecimal("-1234567890123456789.01")
+	in := event{"Event", "launch", at, at, cost, &animal{Class: "Dog", Name: "Rex", Age: 3}, ""}
+	b, err := MarshalBinary(&in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out event
+	if err := UnmarshalBinary(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	in.Day = time.Date(2013, 5, 6, 0, 0, 0, 0, time.UTC)
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("got  %+v\nwant %+v", out, in)
+	}
+}
+
+func TestTwosComplement(t *testing.T) {
+	for _, c := range []struct {
+		n int64
+		b string
+	}{
+		{0, "00"}, {127, "7f"}, {128, "0080"}, {-1, "ff"},
+		{-128, "80"}, {-129, "ff7f"}, {65535, "00ffff"}, {-65536, "ff0000"},
+	} {
+		b := twosComplement(big.NewInt(c.n))
+		if hex.EncodeToString(b) != c.b {
+			t.Errorf("%d: got %x, want %s", c.n, b, c.b)
+		}
+		if n := fromTwosComplement(b); n.Int64() != c.n {
+			t.Errorf("%s: got %v, want %d", c.b, n, c.n)
+		}
+	}
+}
+
+func TestBinaryErrors(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"01",                           // version
+		"000c416e696d",                 // class cut short
+		"00000b",                       // property id instead of a name
+		"0000086e616d650000000a0700",   // pointer past the end
+		"0000086e616d650000000a1400ff", // unknown type
+	} {
+		b, _ := hex.DecodeString(s)
+		if _, err := decodeBinary(b, nil, nil, nil); err == nil {
+			t.Errorf("%s: expected error", s)
+		} else if _, ok := err.(*SyntaxError); !ok {
+			t.Errorf("%s: got %T: %v", s, err, err)
+		}
+	}
+
+	if _, err := MarshalBinary(42); err == nil {
+		t.Error("MarshalBinary(42): expected error")
+	}
+	if _, err := MarshalBinary(map[string]interface{}{"f": 1}); err == nil {
+		t.Error("MarshalBinary(map): expected error")
+	}
+	d := NewDocument("")
+	d.Set("ch", make(chan int))
+	if _, err := MarshalBinary(d); err == nil {
+		t.Error("MarshalBinary(chan field): expected error")
+	} else if _, ok := err.(*UnsupportedTypeError); !ok {
+		t.Errorf("got %T: %v", err, err)
+	}
+}
+
+type unsigned struct {
+	U16 uint16 `orient:"u16"`
+	U32 uint32 `orient:"u32"`
+	U64 uint64 `orient:"u64"`
+}
+
+type node struct {
+	Next *node `orient:"next"`
+}
+
+// Unsigned integers are written as a type wide enough to hold them.
+func TestBinaryUnsigned(t *testing.T) {
+	in := unsigned{math.MaxUint16, math.MaxUint32, math.MaxInt64}
+	b, err := MarshalBinary(&in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out unsigned
+	if err := UnmarshalBinary(b, &out); err != nil || out != in {
+		t.Errorf("got %+v, %v", out, err)
+	}
+	d, err := decodeBinary(b, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Fields["u16"] != int32(math.MaxUint16) || d.Fields["u32"] != int64(math.MaxUint32) {
+		t.Errorf("decoded %v", d.Fields)
+	}
+
+	in.U64 = math.MaxUint64
+	if _, err := MarshalBinary(&in); err == nil {
+		t.Error("MaxUint64: expected error")
+	} else if _, ok := err.(*UnsupportedValueError); !ok {
+		t.Errorf("MaxUint64: got %T: %v", err, err)
+	}
+}
+
+func TestBinaryCycle(t *testing.T) {
+	n := &node{}
+	n.Next = n
+	m := map[string]interface{}{}
+	m["m"] = m
+	d := NewDocument("")
+	d.Set("m", m)
+	for _, v := range []interface{}{n, d} {
+		if _, err := MarshalBinary(v); err == nil {
+			t.Errorf("MarshalBinary(%T): expected error", v)
+		} else if _, ok := err.(*UnsupportedValueError); !ok {
+			t.Errorf("MarshalBinary(%T): got %T: %v", v, err, err)
+		}
+	}
+}
+
+func TestBinarySession(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.close()
+	conn, err := net.Dial("tcp", s.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	x := &Xx{Serializer: SerializerBinary}
+	if err := x.openConn(conn, "test", "admin", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	defer x.close()
+
+	rec, _, err := x.loadRecord(Rid{9, 1}, "")
+	if d, ok := rec.Value.(*Document); err != nil || !ok || d.Fields["name"] != "Fido" {
+		t.Fatalf("loadRecord: got %v, %v", rec, err)
+	}
+	var pushed Record
+	x.onRecordPush(func(r Record) { pushed = r })
+	rid, _, err := x.createRecord(9, &animal{Class: "Animal", Name: "Pip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := x.updateRecord(rid, &animal{Class: "Animal", Name: "Pip", Age: 4}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if d, ok := pushed.Value.(*Document); !ok || d.Fields["Age"] != int64(4) {
+		t.Errorf("pushed %v", pushed)
+	}
+	rs, err := x.command("select from Animal", "q", 's', -1, "")
+	if err != nil || len(rs.Records) != 2 {
+		t.Errorf("command: got %v, %v", rs, err)
+	}
+	rs, err = x.command("select from Animal", "q", 's', -1, "*:-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, ok := rs.Prefetch[Rid{9, 1}].Value.(*Document); !ok || d.Fields["name"] != "Fido" {
+		t.Errorf("command with fetch plan: prefetched %v", rs.Prefetch)
+	}
+
+	// Protocols before 22 only have the record string format.
+	old := newFakeServerVersion(t, 15)
+	defer old.close()
+	conn, err = net.Dial("tcp", old.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	y := &Xx{Serializer: SerializerBinary}
+	if err := y.openConn(conn, "test", "admin", "admin"); err == nil {
+		t.Error("binary serializer with protocol 15: expected error")
+		y.close()
+	}
+}
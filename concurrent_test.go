@@ -0,0 +1,90 @@
+package gorient
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// Run with -race.  Many goroutines share one connection; each checks that
+// it gets the responses to its own requests.
+func TestConcurrentRequests(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.close()
+	x, _ := dialFake(t, s)
+	defer x.close()
+
+	const workers, iters = 16, 50
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			errs <- hammer(x, w, iters)
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func hammer(x *Xx, w, iters int) error {
+	for i := 0; i < iters; i++ {
+		name := fmt.Sprintf("w%d-%d", w, i)
+		rid, _, err := x.createRecord(int16(10+w), &animal{Class: "Animal", Name: name})
+		if err != nil {
+			return err
+		}
+		rec, _, err := x.loadRecord(rid, "")
+		if err != nil {
+			return err
+		}
+		if d, ok := rec.Value.(*Document); !ok || d.Fields["name"] != name {
+			return fmt.Errorf("loadRecord(%v): got %v, want %s", rid, rec.Value, name)
+		}
+		if _, err := x.size(); err != nil {
+			return err
+		}
+		if i%10 == 0 {
+			if _, err := x.command("select from Animal", "q", 's', -1, ""); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// The callback runs without the connection held, so it can make
+// requests of its own.
+func TestCommandFuncCallback(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.close()
+	x, _ := dialFake(t, s)
+	defer x.close()
+
+	n := 0
+	err := x.commandFunc("select from Animal", "q", 's', -1, "", func(r Record) error {
+		rec, _, err := x.loadRecord(r.Rid, "")
+		if err != nil {
+			return err
+		}
+		if rec.Version != r.Version {
+			return fmt.Errorf("version %d, want %d", rec.Version, r.Version)
+		}
+		n++
+		return nil
+	})
+	if err != nil || n != 1 {
+		t.Errorf("got %d records, %v", n, err)
+	}
+
+	stop := fmt.Errorf("stop")
+	if err := x.commandFunc("select from Animal", "q", 's', -1, "", func(Record) error { return stop }); err != stop {
+		t.Errorf("got %v, want the callback's error", err)
+	}
+}
@@ -0,0 +1,133 @@
+package gorient
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestContextDeadline(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.close()
+	x, _ := dialFake(t, s)
+	defer x.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, _, err := x.loadRecordContext(ctx, Rid{9, 1}, ""); err != nil {
+		t.Fatal(err)
+	}
+	// The deadline is cleared after the request.
+	time.Sleep(60 * time.Millisecond)
+	if _, err := x.size(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, _, err := x.loadRecordContext(ctx, Rid{stallCluster, 0}, "")
+	if err != context.DeadlineExceeded {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("request took %v", d)
+	}
+
+	// The half-read response makes the connection unusable.
+	if _, err := x.size(); err == nil {
+		t.Error("size after aborted request: expected error")
+	} else if e, ok := err.(*AbortedError); !ok || e.Err != context.DeadlineExceeded {
+		t.Errorf("size after aborted request: got %v", err)
+	}
+}
+
+func TestContextCancel(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.close()
+	x, _ := dialFake(t, s)
+	defer x.close()
+
+	// A context already done sends nothing and leaves the connection
+	// usable.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := x.commandContext(ctx, "select from Animal", "q", 's', -1, ""); err != context.Canceled {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+	if _, err := x.size(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	if _, _, err := x.loadRecordContext(ctx, Rid{stallCluster, 0}, ""); err != context.Canceled {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+	if !x.broken() {
+		t.Error("connection still usable after cancelled request")
+	}
+}
+
+func TestOpenContext(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var x Xx
+	if err := x.openContext(ctx, s.addr(), "test", "admin", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	defer x.close()
+	if n, err := x.sizeContext(ctx); n != 1 || err != nil {
+		t.Errorf("size: got %d, %v", n, err)
+	}
+}
+
+// cancelConn cancels a context after its next read, then gives the
+// request's watcher time to see it.
+type cancelConn struct {
+	net.Conn
+	cancel context.CancelFunc
+}
+
+func (c *cancelConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if c.cancel != nil {
+		c.cancel()
+		c.cancel = nil
+		time.Sleep(20 * time.Millisecond)
+	}
+	return n, err
+}
+
+func TestContextCancelAfterResponse(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.close()
+	client, server := net.Pipe()
+	go s.handle(server)
+	cc := &cancelConn{Conn: client}
+	var x Xx
+	if err := x.openConn(cc, "test", "admin", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	defer x.close()
+
+	// The whole response arrives in the read that cancels, so the
+	// request succeeds despite the cancellation.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cc.cancel = cancel
+	if _, err := x.sizeContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// And it leaves no deadline behind.
+	if _, err := x.size(); err != nil {
+		t.Errorf("size after cancelled context: %v", err)
+	}
+}
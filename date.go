@@ -0,0 +1,44 @@
+package gorient
+
+import (
+	"reflect"
+	"time"
+)
+
+// A Date is the value of a date field (as opposed to a datetime): midnight
+// on a calendar day in the database server's time zone.  Dates decode to
+// Date, and a Date is written back as a date, where a time.Time would be
+// written as a datetime.
+type Date struct {
+	time.Time
+}
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+	dateType = reflect.TypeOf(Date{})
+)
+
+// msTime converts milliseconds since the epoch to a time in loc, or UTC
+// if loc is nil.
+func msTime(ms int64, loc *time.Location) time.Time {
+	return time.Unix(ms/1000, ms%1000*int64(time.Millisecond)).In(orUTC(loc))
+}
+
+// timeMs converts t to milliseconds since the epoch.
+func timeMs(t time.Time) int64 {
+	return t.Unix()*1000 + int64(t.Nanosecond())/int64(time.Millisecond)
+}
+
+// dateOf returns midnight in loc (or UTC) on the calendar day of t, as
+// seen in t's own location.
+func dateOf(t time.Time, loc *time.Location) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, orUTC(loc))
+}
+
+func orUTC(loc *time.Location) *time.Location {
+	if loc == nil {
+		return time.UTC
+	}
+	return loc
+}
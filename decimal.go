@@ -0,0 +1,144 @@
+package gorient
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Decimal is an exact decimal number, unscaled × 10^-scale, as stored in
+// BigDecimal fields.  Unlike a float it keeps every digit, and unlike a
+// big.Rat it keeps the scale, so "1.50" is written back as "1.50".
+//
+// The zero Decimal is 0.
+type Decimal struct {
+	unscaled *big.Int
+	scale    int32
+}
+
+// NewDecimal returns the Decimal unscaled × 10^-scale.
+func NewDecimal(unscaled *big.Int, scale int32) Decimal {
+	return Decimal{new(big.Int).Set(unscaled), scale}
+}
+
+// ParseDecimal parses a decimal number in plain ("-12.50") or scientific
+// ("1.25E+3") notation.
+func ParseDecimal(s string) (Decimal, error) {
+	mant, exp := s, int64(0)
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		var err error
+		mant = s[:i]
+		exp, err = strconv.ParseInt(s[i+1:], 10, 32)
+		if err != nil {
+			return Decimal{}, fmt.Errorf("gorient: invalid decimal %q", s)
+		}
+	}
+	digits := mant
+	frac := 0
+	if i := strings.IndexByte(mant, '.'); i >= 0 {
+		digits = mant[:i] + mant[i+1:]
+		frac = len(mant) - i - 1
+	}
+	// SetString would accept an underscore or base prefix; we don't.
+	d := strings.TrimLeft(digits, "+-")
+	if len(d) == 0 || len(digits)-len(d) > 1 || strings.Trim(d, "0123456789") != "" {
+		return Decimal{}, fmt.Errorf("gorient: invalid decimal %q", s)
+	}
+	u, _ := new(big.Int).SetString(digits, 10)
+	scale := int64(frac) - exp
+	if scale != int64(int32(scale)) {
+		return Decimal{}, fmt.Errorf("gorient: decimal %q out of range", s)
+	}
+	return Decimal{u, int32(scale)}, nil
+}
+
+// Unscaled returns the unscaled value of d.
+func (d Decimal) Unscaled() *big.Int {
+	if d.unscaled == nil {
+		return new(big.Int)
+	}
+	return new(big.Int).Set(d.unscaled)
+}
+
+// Scale returns the number of digits after the decimal point.
+func (d Decimal) Scale() int32 {
+	return d.scale
+}
+
+// Rat returns d as a fraction.
+func (d Decimal) Rat() *big.Rat {
+	r := new(big.Rat).SetInt(d.Unscaled())
+	p := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(abs32(d.scale))), nil)
+	if d.scale > 0 {
+		return r.Quo(r, new(big.Rat).SetInt(p))
+	}
+	return r.Mul(r, new(big.Rat).SetInt(p))
+}
+
+// Float64 returns the float64 nearest to d.
+func (d Decimal) Float64() float64 {
+	f, _ := d.Rat().Float64()
+	return f
+}
+
+// String formats d in plain notation when its scale is positive, and as
+// an integer with an exponent otherwise, so that parsing the result gives
+// back the same scale.
+func (d Decimal) String() string {
+	s := d.Unscaled().String()
+	if d.scale == 0 {
+		return s
+	}
+	if d.scale < 0 {
+		return s + "E+" + strconv.Itoa(int(-d.scale))
+	}
+	neg := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+	if n := int(d.scale) + 1 - len(s); n > 0 {
+		s = strings.Repeat("0", n) + s
+	}
+	i := len(s) - int(d.scale)
+	s = s[:i] + "." + s[i:]
+	if neg {
+		s = "-" + s
+	}
+	return s
+}
+
+// ratDecimal returns x as a Decimal of the smallest scale that holds it
+// exactly, or false if it has no finite decimal expansion (as 1/3).
+func ratDecimal(x *big.Rat) (Decimal, bool) {
+	den := new(big.Int).Set(x.Denom())
+	var twos, fives int32
+	for den.Bit(0) == 0 {
+		den.Rsh(den, 1)
+		twos++
+	}
+	five, q, m := big.NewInt(5), new(big.Int), new(big.Int)
+	for {
+		q.QuoRem(den, five, m)
+		if m.Sign() != 0 {
+			break
+		}
+		den.Set(q)
+		fives++
+	}
+	if den.Cmp(big.NewInt(1)) != 0 {
+		return Decimal{}, false
+	}
+	scale := twos
+	if fives > scale {
+		scale = fives
+	}
+	u := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(scale)), nil)
+	u.Mul(u, x.Num())
+	return Decimal{u.Quo(u, x.Denom()), scale}, true
+}
+
+func abs32(n int32) int32 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,125 @@
+package gorient
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestDecimal(t *testing.T) {
+	tests := []struct {
+		in       string
+		unscaled string
+		scale    int32
+		out      string
+	}{
+		{"0", "0", 0, "0"},
+		{"1.50", "150", 2, "1.50"},
+		{"-1.50", "-150", 2, "-1.50"},
+		{"+7", "7", 0, "7"},
+		{"0.001", "1", 3, "0.001"},
+		{"-0.001", "-1", 3, "-0.001"},
+		{".5", "5", 1, "0.5"},
+		{"0.58595884848484", "58595884848484", 14, "0.58595884848484"},
+		{"123456789012345678901234567890.123456789", "123456789012345678901234567890123456789", 9,
+			"123456789012345678901234567890.123456789"},
+		{"1.0E-7", "10", 8, "0.00000010"},
+		{"1.25E+3", "125", -1, "125E+1"},
+		{"1E+3", "1", -3, "1E+3"},
+	}
+	for _, tt := range tests {
+		d, err := ParseDecimal(tt.in)
+		if err != nil {
+			t.Errorf("ParseDecimal(%q): %v", tt.in, err)
+			continue
+		}
+		if d.Unscaled().String() != tt.unscaled || d.Scale() != tt.scale {
+			t.Errorf("ParseDecimal(%q) = %v × 10^-%d", tt.in, d.Unscaled(), d.Scale())
+		}
+		if s := d.String(); s != tt.out {
+			t.Errorf("ParseDecimal(%q).String() = %q, want %q", tt.in, s, tt.out)
+		}
+		if d2, _ := ParseDecimal(d.String()); d2.Scale() != d.Scale() || d2.Unscaled().Cmp(d.Unscaled()) != 0 {
+			t.Errorf("%q does not round trip", tt.in)
+		}
+	}
+
+	for _, s := range []string{"", "-", ".", "1.2.3", "0x10", "1_000", "--1", "1e", "1E+99999999999", "abc"} {
+		if d, err := ParseDecimal(s); err == nil {
+			t.Errorf("ParseDecimal(%q) = %v, want error", s, d)
+		}
+	}
+
+	var zero Decimal
+	if zero.String() != "0" || zero.Rat().Sign() != 0 {
+		t.Errorf("zero Decimal is %v", zero)
+	}
+
+	d := NewDecimal(big.NewInt(-125), 2)
+	if r := d.Rat(); r.Cmp(big.NewRat(-5, 4)) != 0 {
+		t.Errorf("Rat() = %v", r)
+	}
+	if f := d.Float64(); f != -1.25 {
+		t.Errorf("Float64() = %v", f)
+	}
+	if r := (Decimal{big.NewInt(3), -2}).Rat(); r.Cmp(big.NewRat(300, 1)) != 0 {
+		t.Errorf("Rat() = %v", r)
+	}
+}
+
+func TestDecimalField(t *testing.T) {
+	s := `price:19.990c,total:1234567890123456789.01c,approx:0.5c`
+	var v struct {
+		Price  Decimal  `orient:"price"`
+		Total  *big.Rat `orient:"total"`
+		Approx float64  `orient:"approx"`
+	}
+	if err := Unmarshal([]byte(s), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Price.String() != "19.990" {
+		t.Errorf("price: got %v", v.Price)
+	}
+	if v.Total.FloatString(2) != "1234567890123456789.01" {
+		t.Errorf("total: got %v", v.Total)
+	}
+	if v.Approx != 0.5 {
+		t.Errorf("approx: got %v", v.Approx)
+	}
+
+	b, err := Marshal(parse(s))
+	if err != nil || string(b) != s {
+		t.Errorf("Marshal: got %s, %v", b, err)
+	}
+}
+
+func TestEncodeRat(t *testing.T) {
+	total, _ := new(big.Rat).SetString("1234567890123456789.01")
+	v := struct {
+		Total *big.Rat `orient:"total"`
+		Half  big.Rat  `orient:"half"`
+	}{total, *big.NewRat(-1, 2)}
+	b, err := Marshal(&v)
+	if want := `total:1234567890123456789.01c,half:-0.5c`; err != nil || string(b) != want {
+		t.Errorf("Marshal: got %s, %v; want %s", b, err, want)
+	}
+
+	b, err = MarshalBinary(&v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var d Document
+	if err := UnmarshalBinary(b, &d); err != nil {
+		t.Fatal(err)
+	}
+	if dec, ok := d.Fields["total"].(Decimal); !ok || dec.String() != "1234567890123456789.01" {
+		t.Errorf("MarshalBinary: total %v", d.Fields["total"])
+	}
+
+	// A fraction with no decimal expansion can't be stored.
+	v.Total = big.NewRat(1, 3)
+	if _, err := Marshal(&v); err == nil {
+		t.Error("Marshal 1/3: expected error")
+	} else if _, ok := err.(*UnsupportedValueError); !ok {
+		t.Errorf("Marshal 1/3: got %v", err)
+	}
+}
@@ -0,0 +1,393 @@
+package gorient
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	r "reflect"
+	"time"
+)
+
+// Unmarshal parses a document in the record string format and stores the
+// result in the value pointed to by v.
+//
+// v may point to a *Document, a Document, a map with string keys, an
+// empty interface, or a struct.  Document fields are matched to struct
+// fields by the name in the field's `orient` tag, or the field name if
+// there is no tag, preferring an exact match.  The document class is
+// stored in the string field tagged `orient:"@class"`, if any.
+// Embedded documents and maps fill nested structs, maps or *Document
+// values, and numbers are converted to any numeric field they fit in.
+// Bytes are signed, as on the server, except in a uint8 field, which
+// gets the byte as written.
+//
+// Dates decode to Date, midnight UTC, and datetimes to time.Time in UTC;
+// either can be stored in a time.Time field.  UnmarshalInLocation
+// decodes them in the database server's time zone instead.
+//
+// Given a *Document, Unmarshal replaces its class and fields, reusing
+// its storage.  data is not retained.
+func Unmarshal(data []byte, v interface{}) error {
+	return UnmarshalInLocation(data, v, nil)
+}
+
+// UnmarshalInLocation is Unmarshal with dates at midnight in loc, and
+// datetimes in loc.  A nil loc means UTC.
+func UnmarshalInLocation(data []byte, v interface{}, loc *time.Location) error {
+	rv := r.ValueOf(v)
+	if rv.Kind() != r.Ptr || rv.IsNil() {
+		return &InvalidUnmarshalError{r.TypeOf(v)}
+	}
+	return unmarshal(decode, data, rv, nil, loc)
+}
+
+// unmarshal decodes data, in the format read by dec, into rv.
+func unmarshal(dec func([]byte, *Document, nameCache, *time.Location) (*Document, error), data []byte, rv r.Value, names nameCache, loc *time.Location) error {
+	// Parse straight into a *Document destination, reusing its storage.
+	if doc, ok := rv.Interface().(*Document); ok {
+		_, err := dec(data, doc, names, loc)
+		return err
+	}
+	doc, err := dec(data, nil, names, loc)
+	if err != nil {
+		return err
+	}
+	d := &decodeState{}
+	d.value(doc, rv)
+	return d.err
+}
+
+// An InvalidUnmarshalError describes an invalid argument passed to
+// Unmarshal.  The argument must be a non-nil pointer.
+type InvalidUnmarshalError struct {
+	Type r.Type
+}
+
+func (e *InvalidUnmarshalError) Error() string {
+	if e.Type == nil {
+		return "gorient: Unmarshal(nil)"
+	}
+	if e.Type.Kind() != r.Ptr {
+		return "gorient: Unmarshal(non-pointer " + e.Type.String() + ")"
+	}
+	return "gorient: Unmarshal(nil " + e.Type.String() + ")"
+}
+
+// An UnmarshalTypeError describes a document value that can't be stored
+// in a Go value of a specific type.
+type UnmarshalTypeError struct {
+	Value string // description of the document value, eg. "string"
+	Type  r.Type // type of the Go value it could not be assigned to
+	Field string // document field holding the value, if known
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	if e.Field != "" {
+		return "gorient: cannot unmarshal " + e.Value + " into field " +
+			e.Field + " of type " + e.Type.String()
+	}
+	return "gorient: cannot unmarshal " + e.Value + " into Go value of type " +
+		e.Type.String()
+}
+
+// decodeState copies parsed values into Go values.  Type mismatches are
+// recorded and skipped, so that as much of the document as possible is
+// decoded; the first one is returned.
+type decodeState struct {
+	field string
+	err   error
+}
+
+func (d *decodeState) saveError(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+func (d *decodeState) typeError(v interface{}, t r.Type) {
+	d.saveError(&UnmarshalTypeError{valueName(v), t, d.field})
+}
+
+func valueName(v interface{}) string {
+	switch v := v.(type) {
+	case *Document:
+		if v.Class != "" {
+			return "document " + v.Class
+		}
+		return "document"
+	case map[string]interface{}:
+		return "map"
+	case []interface{}:
+		return "list"
+	case Set:
+		return "set"
+	case nil:
+		return "null"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+var (
+	documentType = r.TypeOf(Document{})
+	ratType      = r.TypeOf(big.Rat{})
+)
+
+// indirect walks down pointers in rv, allocating as needed, and returns
+// the value they point to.
+func indirect(rv r.Value) r.Value {
+	for rv.Kind() == r.Ptr {
+		if rv.Type().Elem() == documentType {
+			break
+		}
+		if rv.IsNil() {
+			rv.Set(r.New(rv.Type().Elem()))
+		}
+		rv = rv.Elem()
+	}
+	return rv
+}
+
+func (d *decodeState) value(v interface{}, rv r.Value) {
+	if rv.Kind() == r.Ptr && v == nil {
+		if !rv.IsNil() && rv.CanSet() {
+			rv.Set(r.Zero(rv.Type()))
+		}
+		return
+	}
+	if !rv.CanSet() {
+		// The argument to Unmarshal itself
+		rv = rv.Elem()
+	}
+	rv = indirect(rv)
+
+	// A *Document destination takes a parsed document as is.
+	if rv.Kind() == r.Ptr {
+		if doc, ok := v.(*Document); ok {
+			rv.Set(r.ValueOf(doc))
+		} else {
+			d.typeError(v, rv.Type())
+		}
+		return
+	}
+
+	if v == nil {
+		rv.Set(r.Zero(rv.Type()))
+		return
+	}
+	if rv.Kind() == r.Interface && rv.NumMethod() == 0 {
+		rv.Set(r.ValueOf(v))
+		return
+	}
+
+	switch v := v.(type) {
+	case *Document:
+		d.document(v, rv)
+	case map[string]interface{}:
+		d.object(v, rv)
+	case []interface{}:
+		d.list(v, rv)
+	case Set:
+		d.list(v, rv)
+	default:
+		d.scalar(v, rv)
+	}
+}
+
+func (d *decodeState) document(doc *Document, rv r.Value) {
+	switch rv.Kind() {
+	case r.Struct:
+		if rv.Type() == documentType {
+			rv.Set(r.ValueOf(*doc))
+			return
+		}
+		si := cachedStructInfo(rv.Type())
+		if si.class >= 0 {
+			rv.Field(si.class).SetString(doc.Class)
+		}
+		d.fields(doc.Fields, rv, si)
+	case r.Map:
+		d.object(doc.Fields, rv)
+	default:
+		d.typeError(doc, rv.Type())
+	}
+}
+
+func (d *decodeState) object(m map[string]interface{}, rv r.Value) {
+	switch rv.Kind() {
+	case r.Struct:
+		if rv.Type() == documentType {
+			rv.Set(r.ValueOf(Document{Fields: m}))
+			return
+		}
+		d.fields(m, rv, cachedStructInfo(rv.Type()))
+	case r.Map:
+		t := rv.Type()
+		if t.Key().Kind() != r.String {
+			d.typeError(m, t)
+			return
+		}
+		if rv.IsNil() {
+			rv.Set(r.MakeMap(t))
+		}
+		outer := d.field
+		for k, v := range m {
+			d.field = k
+			ev := r.New(t.Elem()).Elem()
+			d.value(v, ev)
+			rv.SetMapIndex(r.ValueOf(k).Convert(t.Key()), ev)
+		}
+		d.field = outer
+	default:
+		d.typeError(m, rv.Type())
+	}
+}
+
+func (d *decodeState) fields(m map[string]interface{}, rv r.Value, si *structInfo) {
+	outer := d.field
+	for k, v := range m {
+		f := si.lookup(k)
+		if f == nil {
+			continue
+		}
+		d.field = k
+		d.value(v, rv.Field(f.index))
+	}
+	d.field = outer
+}
+
+func (d *decodeState) list(l []interface{}, rv r.Value) {
+	switch rv.Kind() {
+	case r.Slice:
+		if rv.IsNil() || rv.Cap() < len(l) {
+			rv.Set(r.MakeSlice(rv.Type(), len(l), len(l)))
+		} else {
+			rv.SetLen(len(l))
+		}
+	case r.Array:
+		if rv.Len() != len(l) {
+			d.typeError(l, rv.Type())
+			return
+		}
+	default:
+		d.typeError(l, rv.Type())
+		return
+	}
+	for i, v := range l {
+		d.value(v, rv.Index(i))
+	}
+}
+
+func (d *decodeState) scalar(v interface{}, rv r.Value) {
+	sv := r.ValueOf(v)
+	if sv.Type().AssignableTo(rv.Type()) {
+		rv.Set(sv)
+		return
+	}
+
+	if date, ok := v.(Date); ok && rv.Type() == timeType {
+		rv.Set(r.ValueOf(date.Time))
+		return
+	}
+
+	if dec, ok := v.(Decimal); ok {
+		switch {
+		case isFloat(rv.Kind()):
+			rv.SetFloat(dec.Float64())
+		case rv.Type() == ratType:
+			rv.Set(r.ValueOf(*dec.Rat()))
+		default:
+			d.typeError(v, rv.Type())
+		}
+		return
+	}
+
+	switch sk := sv.Kind(); {
+	case isInt(sk) || isUint(sk) || isFloat(sk):
+		if !setNumber(sv, rv) {
+			d.typeError(v, rv.Type())
+		}
+	case sk == rv.Kind() && (sk == r.String || sk == r.Bool):
+		rv.Set(sv.Convert(rv.Type()))
+	default:
+		d.typeError(v, rv.Type())
+	}
+}
+
+func isInt(k r.Kind) bool   { return k >= r.Int && k <= r.Int64 }
+func isUint(k r.Kind) bool  { return k >= r.Uint && k <= r.Uintptr }
+func isFloat(k r.Kind) bool { return k == r.Float32 || k == r.Float64 }
+
+// setNumber stores the number sv in the numeric value rv, reporting
+// false if rv isn't numeric or can't represent sv exactly.  A byte (uint8)
+// sv is taken to be signed.
+func setNumber(sv, rv r.Value) bool {
+	sk, k := sv.Kind(), rv.Kind()
+	if sk == r.Uint8 && k != r.Uint8 {
+		// Document bytes are signed, as on the server; only a byte
+		// field gets the raw bits.
+		sv, sk = r.ValueOf(int8(sv.Uint())), r.Int8
+	}
+	switch {
+	case isInt(k):
+		var n int64
+		switch {
+		case isInt(sk):
+			n = sv.Int()
+		case isUint(sk):
+			u := sv.Uint()
+			if u > math.MaxInt64 {
+				return false
+			}
+			n = int64(u)
+		default:
+			f := sv.Float()
+			if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+				return false
+			}
+			n = int64(f)
+		}
+		if rv.OverflowInt(n) {
+			return false
+		}
+		rv.SetInt(n)
+	case isUint(k):
+		var n uint64
+		switch {
+		case isInt(sk):
+			i := sv.Int()
+			if i < 0 {
+				return false
+			}
+			n = uint64(i)
+		case isUint(sk):
+			n = sv.Uint()
+		default:
+			f := sv.Float()
+			if f != math.Trunc(f) || f < 0 || f >= math.MaxUint64 {
+				return false
+			}
+			n = uint64(f)
+		}
+		if rv.OverflowUint(n) {
+			return false
+		}
+		rv.SetUint(n)
+	case isFloat(k):
+		var f float64
+		switch {
+		case isInt(sk):
+			f = float64(sv.Int())
+		case isUint(sk):
+			f = float64(sv.Uint())
+		default:
+			f = sv.Float()
+		}
+		if rv.OverflowFloat(f) {
+			return false
+		}
+		rv.SetFloat(f)
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,156 @@
+package gorient
+
+import (
+	"reflect"
+	"testing"
+)
+
+type animal struct {
+	Class string `orient:"@class"`
+	Name  string `orient:"name"`
+	Age   int
+}
+
+type profile struct {
+	Class     string `orient:"@class"`
+	Nick      string `orient:"nick"`
+	Name      string `orient:"name,omitempty"`
+	Age       int64  `orient:"age"`
+	Salary    float64
+	Followers []Rid `orient:"followers"`
+	Follows   []Rid `orient:"follows"`
+	Location  *Rid  `orient:"location"`
+	Dog       animal
+	Cat       *animal          `orient:"cat"`
+	X         []uint8          `orient:"x"`
+	Extra     map[string]int16 `orient:"extra"`
+	Ignored   string           `orient:"-"`
+	hidden    string
+}
+
+func TestUnmarshalStruct(t *testing.T) {
+	s := `Profile@nick:"B \"POTUS\" Obama",follows:[],followers:[#10:5,#10:6],name:"Barack",age:51,location:#3:2,salary:120.5f,dog:(Animal@name:"Fido"),cat:(name:"Pip",age:7s),x:<1,2>,extra:{"a":1b,"b":2},Ignored:"no",hidden:"no",unknown:1`
+
+	var p profile
+	if err := Unmarshal([]byte(s), &p); err != nil {
+		t.Fatal(err)
+	}
+	loc := Rid{3, 2}
+	want := profile{
+		Class:     "Profile",
+		Nick:      `B "POTUS" Obama`,
+		Name:      "Barack",
+		Age:       51,
+		Salary:    120.5,
+		Followers: []Rid{{10, 5}, {10, 6}},
+		Follows:   []Rid{},
+		Location:  &loc,
+		Dog:       animal{Class: "Animal", Name: "Fido"},
+		Cat:       &animal{Name: "Pip", Age: 7},
+		X:         []uint8{1, 2},
+		Extra:     map[string]int16{"a": 1, "b": 2},
+	}
+	if !reflect.DeepEqual(p, want) {
+		t.Errorf("got  %+v\nwant %+v", p, want)
+	}
+}
+
+func TestUnmarshalSignedByte(t *testing.T) {
+	type bytes struct {
+		I8  int8    `orient:"a"`
+		I64 int64   `orient:"b"`
+		F   float64 `orient:"c"`
+		U8  uint8   `orient:"d"`
+	}
+	var v bytes
+	if err := Unmarshal([]byte(`a:-12b,b:-12b,c:-12b,d:-12b`), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v != (bytes{-12, -12, -12, 244}) {
+		t.Errorf("got %+v", v)
+	}
+	if n, err := parse(`b:-12b`).GetInt64("b"); n != -12 || err != nil {
+		t.Errorf("GetInt64: got %d, %v", n, err)
+	}
+
+	// Both kinds of byte field round trip.
+	w := struct {
+		I8 int8  `orient:"i"`
+		U8 uint8 `orient:"u"`
+	}{-12, 244}
+	b, err := Marshal(&w)
+	if err != nil || string(b) != "i:-12b,u:-12b" {
+		t.Fatalf("Marshal: got %s, %v", b, err)
+	}
+	w.I8, w.U8 = 0, 0
+	if err := Unmarshal(b, &w); err != nil || w.I8 != -12 || w.U8 != 244 {
+		t.Errorf("round trip: got %+v, %v", w, err)
+	}
+
+	// A negative byte doesn't fit a wider unsigned field.
+	var u struct {
+		U16 uint16 `orient:"b"`
+	}
+	if err := Unmarshal([]byte(`b:-12b`), &u); err == nil {
+		t.Errorf("uint16: got %d, want error", u.U16)
+	}
+}
+
+func TestUnmarshalDocument(t *testing.T) {
+	s := `Animal@name:"Fido",age:3`
+
+	var d *Document
+	if err := Unmarshal([]byte(s), &d); err != nil {
+		t.Fatal(err)
+	}
+	if d.Class != "Animal" || d.Fields["age"] != int32(3) {
+		t.Errorf("got %v", d)
+	}
+
+	var m map[string]interface{}
+	if err := Unmarshal([]byte(s), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m["name"] != "Fido" || m["age"] != int32(3) {
+		t.Errorf("got %v", m)
+	}
+
+	var i interface{}
+	if err := Unmarshal([]byte(s), &i); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := i.(*Document); !ok {
+		t.Errorf("got %T", i)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	var a animal
+	if err := Unmarshal([]byte(`name:"x"`), a); err == nil {
+		t.Error("expected InvalidUnmarshalError")
+	}
+	if err := Unmarshal([]byte(`name:"x"`), nil); err == nil {
+		t.Error("expected InvalidUnmarshalError")
+	}
+
+	var small struct {
+		B int8
+		S string
+	}
+	err := Unmarshal([]byte(`B:300,S:"ok"`), &small)
+	if e, ok := err.(*UnmarshalTypeError); !ok || e.Field != "B" {
+		t.Errorf("got %v, want UnmarshalTypeError for B", err)
+	}
+	if small.S != "ok" {
+		t.Error("decoding stopped at first error")
+	}
+
+	err = Unmarshal([]byte(`name:12`), &a)
+	if _, ok := err.(*UnmarshalTypeError); !ok {
+		t.Errorf("got %v, want UnmarshalTypeError", err)
+	}
+
+	if err := Unmarshal([]byte(`name:"x",:`), &a); err == nil {
+		t.Error("expected parse error")
+	}
+}
@@ -0,0 +1,45 @@
+package gorient
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+)
+
+// A Dialer opens the network connection to a server.  *net.Dialer and
+// *tls.Dialer are Dialers; tests can return in-memory pipes.
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// dialFunc returns the function open uses to dial host, and reconnect
+// to redial it: x.Dialer (or a net.Dialer) over TCP, followed by a TLS
+// handshake if x.TLS is set.
+func (x *Xx) dialFunc(host string) func(context.Context) (net.Conn, error) {
+	d := x.Dialer
+	if d == nil {
+		d = &net.Dialer{}
+	}
+	config := x.TLS
+	if config != nil && config.ServerName == "" {
+		// Verify the certificate against the host dialed.
+		name, _, err := net.SplitHostPort(host)
+		if err != nil {
+			name = host
+		}
+		config = config.Clone()
+		config.ServerName = name
+	}
+	return func(ctx context.Context) (net.Conn, error) {
+		conn, err := d.DialContext(ctx, "tcp", host)
+		if err != nil || config == nil {
+			return conn, err
+		}
+		tc := tls.Client(conn, config)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tc, nil
+	}
+}
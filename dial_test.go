@@ -0,0 +1,173 @@
+package gorient
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// pipeDialer connects to a fake server over net.Pipe.
+type pipeDialer struct {
+	s     *fakeServer
+	dials int
+}
+
+func (d *pipeDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.dials++
+	client, server := net.Pipe()
+	go d.s.handle(server)
+	return client, nil
+}
+
+// tlsDialer connects to a TLS listener in front of a fake server,
+// whatever the address dialed.
+type tlsDialer struct {
+	ln net.Listener
+}
+
+// listenTLS starts a TLS listener with config that hands its
+// connections to s.  It listens on loopback TCP rather than a pipe, so
+// that one side's handshake messages don't wait on the other's.
+func listenTLS(t *testing.T, s *fakeServer, config *tls.Config) *tlsDialer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln = tls.NewListener(ln, config)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				tc := conn.(*tls.Conn)
+				tc.SetDeadline(time.Now().Add(5 * time.Second))
+				if err := tc.Handshake(); err != nil {
+					tc.Close()
+					return
+				}
+				tc.SetDeadline(time.Time{})
+				s.handle(tc)
+			}()
+		}
+	}()
+	return &tlsDialer{ln}
+}
+
+func (d *tlsDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var nd net.Dialer
+	return nd.DialContext(ctx, network, d.ln.Addr().String())
+}
+
+// testCert returns a certificate for name signed by ca, or self-signed
+// if ca is nil.
+func testCert(t *testing.T, name string, ca *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	parent, signer := tmpl, interface{}(key)
+	if ca == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		parent, signer = ca.Leaf, ca.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestDialer(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.close()
+	d := &pipeDialer{s: s}
+	x := &Xx{Dialer: d, Reconnect: true}
+	if err := x.open("db.example:2424", "test", "admin", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	defer x.close()
+	if _, _, err := x.loadRecord(Rid{9, 1}, ""); err != nil {
+		t.Fatal(err)
+	}
+	// Reconnecting dials with it too.
+	x.conn.Close()
+	if _, err := x.size(); err != nil {
+		t.Fatal(err)
+	}
+	if d.dials != 2 {
+		t.Errorf("dials: got %d, want 2", d.dials)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.close()
+	ca := testCert(t, "Test CA", nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	d := listenTLS(t, s, &tls.Config{
+		Certificates: []tls.Certificate{testCert(t, "db.example", &ca)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    roots,
+	})
+	defer d.ln.Close()
+	client := testCert(t, "client", &ca)
+
+	x := &Xx{Dialer: d, TLS: &tls.Config{
+		Certificates: []tls.Certificate{client},
+		RootCAs:      roots,
+	}}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := x.openContext(ctx, "db.example:2424", "test", "admin", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := x.conn.(*tls.Conn); !ok {
+		t.Errorf("connection is a %T", x.conn)
+	}
+	if _, _, err := x.loadRecord(Rid{9, 1}, ""); err != nil {
+		t.Error(err)
+	}
+	x.close()
+
+	for _, c := range []struct {
+		name   string
+		host   string
+		config *tls.Config
+	}{
+		{"wrong host", "other.example:2424", &tls.Config{Certificates: []tls.Certificate{client}, RootCAs: roots}},
+		{"wrong ServerName", "db.example:2424", &tls.Config{Certificates: []tls.Certificate{client}, RootCAs: roots, ServerName: "other.example"}},
+		{"unknown CA", "db.example:2424", &tls.Config{Certificates: []tls.Certificate{client}}},
+	} {
+		x := &Xx{Dialer: d, TLS: c.config}
+		if err := x.openContext(ctx, c.host, "test", "admin", "admin"); err == nil {
+			t.Errorf("%s: expected error", c.name)
+			x.close()
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package gorient
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Document is a record of named fields, optionally of a class.
+//
+// Fields indexes the field values by name.  A document also remembers
+// the order its fields appear in the record, which Names returns: a
+// parsed document keeps the order it was read in, and Set adds new
+// fields at the end.  Fields added to the map directly follow the
+// ordered ones, sorted by name.
+type Document struct {
+	Class  string
+	Fields map[string]interface{}
+	order  []string // field names in record order
+}
+
+// NewDocument returns an empty document of the given class.
+func NewDocument(class string) *Document {
+	return &Document{Class: class, Fields: make(map[string]interface{})}
+}
+
+// Reset removes all fields and the class from d, keeping the storage for
+// reuse.
+func (d *Document) Reset() {
+	d.Class = ""
+	if d.Fields == nil {
+		d.Fields = make(map[string]interface{}, 8)
+	}
+	for k := range d.Fields {
+		delete(d.Fields, k)
+	}
+	d.order = d.order[:0]
+}
+
+// Get returns the value of the named field, and whether it is present.
+func (d *Document) Get(name string) (interface{}, bool) {
+	v, ok := d.Fields[name]
+	return v, ok
+}
+
+// Set sets the value of the named field, adding it after the existing
+// fields if it's new.
+func (d *Document) Set(name string, v interface{}) {
+	if d.Fields == nil {
+		d.Fields = make(map[string]interface{})
+	}
+	if _, ok := d.Fields[name]; !ok {
+		d.order = append(d.order, name)
+	}
+	d.Fields[name] = v
+}
+
+// Delete removes the named field.
+func (d *Document) Delete(name string) {
+	if _, ok := d.Fields[name]; !ok {
+		return
+	}
+	delete(d.Fields, name)
+	for i, n := range d.order {
+		if n == name {
+			d.order = append(d.order[:i], d.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// Names returns the field names in order.
+func (d *Document) Names() []string {
+	names := make([]string, 0, len(d.Fields))
+	seen := 0
+	for _, n := range d.order {
+		if _, ok := d.Fields[n]; ok {
+			names = append(names, n)
+			seen++
+		}
+	}
+	if seen == len(d.Fields) {
+		return names
+	}
+
+	var rest []string
+	for n := range d.Fields {
+		rest = append(rest, n)
+	}
+	sort.Strings(rest)
+	for _, n := range rest {
+		if !d.ordered(n) {
+			names = append(names, n)
+		}
+	}
+	return names
+}
+
+func (d *Document) ordered(name string) bool {
+	for _, n := range d.order {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Document) String() string {
+	if len(d.Class) > 0 {
+		return fmt.Sprintf("%s(%v)", d.Class, d.Fields)
+	}
+	return fmt.Sprintf("(%v)", d.Fields)
+}
@@ -0,0 +1,55 @@
+package gorient
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDocumentOrder(t *testing.T) {
+	s := `Profile@nick:"Neo",zip:12345,age:30s,address:(street:"Main",city:"Zion"),born:`
+	d := parse(s)
+	if want := []string{"nick", "zip", "age", "address", "born"}; !reflect.DeepEqual(d.Names(), want) {
+		t.Errorf("Names() = %v, want %v", d.Names(), want)
+	}
+	b, err := Marshal(d)
+	if err != nil || string(b) != s {
+		t.Errorf("Marshal: got %s, %v\nwant %s", b, err, s)
+	}
+
+	d.Set("zip", int32(54321))
+	d.Set("email", "neo@example.com")
+	d.Delete("age")
+	d.Delete("nope")
+	b, _ = Marshal(d)
+	if want := `Profile@nick:"Neo",zip:54321,address:(street:"Main",city:"Zion"),born:,email:"neo@example.com"`; string(b) != want {
+		t.Errorf("after edits: got %s\nwant %s", b, want)
+	}
+	if v, ok := d.Get("email"); !ok || v != "neo@example.com" {
+		t.Errorf("Get(email) = %v, %v", v, ok)
+	}
+	if _, ok := d.Get("age"); ok {
+		t.Error("Get(age): deleted field still present")
+	}
+}
+
+func TestDocumentNames(t *testing.T) {
+	var d Document
+	d.Set("b", 1)
+	d.Set("a", 2)
+	if names := d.Names(); !reflect.DeepEqual(names, []string{"b", "a"}) {
+		t.Errorf("Names() = %v", names)
+	}
+
+	// Fields added to the map directly follow the ordered ones, sorted.
+	d.Fields["d"] = 3
+	d.Fields["c"] = 4
+	d.order = append(d.order, "gone")
+	if names := d.Names(); !reflect.DeepEqual(names, []string{"b", "a", "c", "d"}) {
+		t.Errorf("Names() = %v", names)
+	}
+
+	d2 := NewDocument("Animal")
+	if d2.Class != "Animal" || len(d2.Names()) != 0 {
+		t.Errorf("NewDocument: %v", d2)
+	}
+}
@@ -2,34 +2,162 @@ package gorient
 
 import (
 	"bytes"
-	"fmt"
+	"encoding/base64"
+	"io"
 	"math"
+	"math/big"
 	r "reflect"
 	"sort"
 	"strconv"
+	"time"
 )
 
+// encWriter is what the encoder writes to: a *bytes.Buffer, a
+// *bufio.Writer or a countWriter.  None of them report errors as they
+// go; a bufio.Writer's surface when it is flushed.
+type encWriter interface {
+	io.Writer
+	io.ByteWriter
+	WriteString(s string) (int, error)
+}
+
 type encodeState struct {
-	bytes.Buffer
+	encWriter
 	scratch [64]byte
+	loc     *time.Location // for dates; nil means UTC
+	depth   int            // of reflectValue calls, to catch cycles
 }
 
+// Marshal returns the record string format encoding of v.
+//
+// A *Document, or a struct, at the top level is written as a record:
+// its class (if any) followed by '@', then comma-separated name:value
+// pairs, ready to be sent as record content.  Nested documents and
+// structs are written the same way, enclosed in parentheses.
+//
+// Struct fields are named by their `orient` tag, as described for
+// Unmarshal.  A field tagged "-" is skipped, and the "omitempty" option
+// skips fields holding the zero value of their type.  The string field
+// tagged "@class" supplies the class name.
+//
+// A time.Time is written as a datetime, or as a date (midnight UTC) if it
+// is a struct field with the "date" tag option.  A Date is written as a
+// date.
+//
+// Unsigned integers are written as the next larger signed type, so
+// uint16 as an integer and uint32 as a long, except that a uint8 is a
+// (signed) byte.  A uint or uint64 above the largest long, and a value
+// that contains itself, can't be written.
 func Marshal(v interface{}) ([]byte, error) {
-	e := &encodeState{}
+	return MarshalInLocation(v, nil)
+}
+
+// MarshalInLocation is Marshal with dates written as midnight in loc, the
+// database server's time zone.  A nil loc means UTC.
+func MarshalInLocation(v interface{}, loc *time.Location) ([]byte, error) {
+	var buf bytes.Buffer
+	e := &encodeState{encWriter: &buf, loc: loc}
 	err := e.marshal(v)
 	if err != nil {
 		return nil, err
 	}
-	return e.Bytes(), nil
+	return buf.Bytes(), nil
+}
+
+// EncodedLen returns the length of the encoding of v, without building
+// it.
+func EncodedLen(v interface{}) (int, error) {
+	return encodedLen(v, nil)
+}
+
+// encodedLen is EncodedLen with dates in loc.
+func encodedLen(v interface{}, loc *time.Location) (int, error) {
+	var n countWriter
+	e := &encodeState{encWriter: &n, loc: loc}
+	if err := e.marshal(v); err != nil {
+		return 0, err
+	}
+	return int(n), nil
 }
-func (e *encodeState) marshal(v interface{}) error {
-	e.reflectValue(r.ValueOf(v))
+
+// countWriter counts the bytes written to it.
+type countWriter int
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	*c += countWriter(len(p))
+	return len(p), nil
+}
+
+func (c *countWriter) WriteByte(b byte) error {
+	*c++
+	return nil
+}
+
+func (c *countWriter) WriteString(s string) (int, error) {
+	*c += countWriter(len(s))
+	return len(s), nil
+}
+
+// An UnsupportedTypeError is returned by Marshal when asked to encode a
+// value of a type with no record string representation.
+type UnsupportedTypeError struct {
+	Type r.Type
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	return "gorient: unsupported type: " + e.Type.String()
+}
+
+// An UnsupportedValueError is returned by Marshal when asked to encode a
+// value that can't be represented, such as a NaN float.
+type UnsupportedValueError struct {
+	Value r.Value
+	Str   string
+}
+
+func (e *UnsupportedValueError) Error() string {
+	return "gorient: unsupported value: " + e.Str
+}
+
+// encodeError wraps errors panicked by the encoder, so marshal can tell
+// them apart from runtime panics.
+type encodeError struct {
+	error
+}
+
+func (e *encodeState) error(err error) {
+	panic(encodeError{err})
+}
+
+func (e *encodeState) marshal(v interface{}) (err error) {
+	defer func() {
+		if x := recover(); x != nil {
+			if ee, ok := x.(encodeError); ok {
+				err = ee.error
+			} else {
+				panic(x)
+			}
+		}
+	}()
+	rv := r.ValueOf(v)
+	for rv.Kind() == r.Ptr || rv.Kind() == r.Interface {
+		if rv.IsNil() {
+			e.WriteString("null")
+			return nil
+		}
+		rv = rv.Elem()
+	}
+	if isDocument(rv.Type()) {
+		e.document(rv)
+	} else {
+		e.reflectValue(rv)
+	}
 	return nil
 }
 
 var suffix map[r.Kind]string = map[r.Kind]string {
 	r.Uint8: "b",
-	r.Uint16: "s",
+	r.Uint32: "l",
 	r.Uint64: "l",
 	r.Uint: "l",
     r.Int8: "b",
@@ -40,10 +168,21 @@ var suffix map[r.Kind]string = map[r.Kind]string {
     r.Float64: "d",
 }
 
+// maxDepth limits the nesting of values, which is deeper only if a value
+// contains itself.
+const maxDepth = 1000
+
 func (e *encodeState) reflectValue(v r.Value) {
+	if e.depth++; e.depth > maxDepth {
+		e.error(&UnsupportedValueError{v, "value nested too deeply, or cyclic"})
+	}
+	defer func() { e.depth-- }()
 
 	k := v.Kind()
 	switch k {
+	case r.Invalid:
+		e.WriteString("null")
+
 	case r.Bool:
 		if v.Bool() {
 			e.WriteString("true")
@@ -51,7 +190,17 @@ func (e *encodeState) reflectValue(v r.Value) {
 			e.WriteString("false")
 		}
 
-	case r.Uint, r.Uint8, r.Uint16, r.Uint32, r.Uint64:
+	case r.Uint8:
+		// Bytes are signed on the server; the parser reads "-12b"
+		// back as byte(244).
+		b := strconv.AppendInt(e.scratch[:0], int64(int8(v.Uint())), 10)
+		e.Write(b)
+		e.WriteString(suffix[k])
+
+	case r.Uint, r.Uint16, r.Uint32, r.Uint64:
+		if v.Uint() > math.MaxInt64 {
+			e.error(&UnsupportedValueError{v, strconv.FormatUint(v.Uint(), 10)})
+		}
 		b := strconv.AppendUint(e.scratch[:0], v.Uint(), 10)
 		e.WriteString(string(b))
 		e.WriteString(suffix[k])
@@ -64,10 +213,16 @@ func (e *encodeState) reflectValue(v r.Value) {
 	case r.Float32, r.Float64:
 		f := v.Float()
 		if math.IsInf(f, 0) || math.IsNaN(f) {
-			// TODO
+			// Java would write "NaN" or "Infinity", but the server
+			// doesn't recognize those as numbers when parsing.
+			e.error(&UnsupportedValueError{v, strconv.FormatFloat(f, 'g', -1, 64)})
 		}
 		b := strconv.AppendFloat(e.scratch[:0], f, 'g', -1, v.Type().Bits())
-		e.WriteString(string(b))
+		// Java writes (and the server looks for) an upper case exponent
+		if i := bytes.IndexByte(b, 'e'); i >= 0 {
+			b[i] = 'E'
+		}
+		e.Write(b)
 		e.WriteString(suffix[k])
 
 	case r.String:
@@ -75,7 +230,7 @@ func (e *encodeState) reflectValue(v r.Value) {
 
 	case r.Map:
 		if v.Type().Key().Kind() != r.String {
-			panic("bad map type")
+			e.error(&UnsupportedTypeError{v.Type()})
 		}
 		if v.IsNil() {
 			e.WriteString("null")
@@ -106,7 +261,193 @@ func (e *encodeState) reflectValue(v r.Value) {
 		}
 		e.reflectValue(v.Elem())
 
+	case r.Slice:
+		if v.Type().Elem().Kind() == r.Uint8 {
+			if v.IsNil() {
+				e.WriteString("null")
+				break
+			}
+			e.binary(v.Bytes())
+			break
+		}
+		if v.Type() == setType {
+			e.elems('<', v, '>')
+			break
+		}
+		e.elems('[', v, ']')
+
+	case r.Array:
+		e.elems('[', v, ']')
+
+	case r.Struct:
+		if v.Type() == ridType {
+			e.Write(v.Interface().(Rid).appendText(e.scratch[:0]))
+			break
+		}
+		if v.Type() == decimalType || v.Type() == ratType {
+			d, err := decimalValue(v)
+			if err != nil {
+				e.error(err)
+			}
+			e.WriteString(d.String())
+			e.WriteByte('c')
+			break
+		}
+		if v.Type() == timeType {
+			e.timestamp(v.Interface().(time.Time), 't')
+			break
+		}
+		if v.Type() == dateType {
+			e.timestamp(v.Interface().(Date).Time, 'a')
+			break
+		}
+		e.WriteByte('(')
+		e.document(v)
+		e.WriteByte(')')
+
 	default:
-		panic(fmt.Sprintf("Unrecognized Kind: %s", k))
+		e.error(&UnsupportedTypeError{v.Type()})
+	}
+}
+
+var (
+	ridType     = r.TypeOf(Rid{})
+	decimalType = r.TypeOf(Decimal{})
+	setType     = r.TypeOf(Set{})
+)
+
+// isDocument reports whether values of type t are written as documents.
+func isDocument(t r.Type) bool {
+	return t != nil && t.Kind() == r.Struct &&
+		t != ridType && t != timeType && t != dateType &&
+		t != decimalType && t != ratType
+}
+
+// decimalValue returns the Decimal or big.Rat v as a Decimal.  A
+// big.Rat must have a finite decimal expansion.
+func decimalValue(v r.Value) (Decimal, error) {
+	if v.Type() == decimalType {
+		return v.Interface().(Decimal), nil
+	}
+	x := v.Interface().(big.Rat)
+	d, ok := ratDecimal(&x)
+	if !ok {
+		return d, &UnsupportedValueError{v, x.String()}
+	}
+	return d, nil
+}
+
+// timestamp writes t as milliseconds since the epoch, suffixed 't' for
+// a datetime or 'a' for a date.
+func (e *encodeState) timestamp(t time.Time, suffix byte) {
+	if suffix == 'a' {
+		t = dateOf(t, e.loc)
+	}
+	e.Write(strconv.AppendInt(e.scratch[:0], timeMs(t), 10))
+	e.WriteByte(suffix)
+}
+
+// elems writes the elements of a slice or array between open and close.
+func (e *encodeState) elems(open byte, v r.Value, close byte) {
+	e.WriteByte(open)
+	for i, n := 0, v.Len(); i < n; i++ {
+		if i > 0 {
+			e.WriteByte(',')
+		}
+		e.reflectValue(v.Index(i))
+	}
+	e.WriteByte(close)
+}
+
+// binary writes b base64 encoded, between underscores.
+func (e *encodeState) binary(b []byte) {
+	e.WriteByte('_')
+	enc := base64.NewEncoder(base64.StdEncoding, e)
+	enc.Write(b)
+	enc.Close()
+	e.WriteByte('_')
+}
+
+// document writes the fields of the Document or struct v, without
+// surrounding parentheses.
+func (e *encodeState) document(v r.Value) {
+	if v.Type() == documentType {
+		d := v.Interface().(Document)
+		if len(d.Class) > 0 {
+			e.WriteString(d.Class)
+			e.WriteByte('@')
+		}
+		for i, k := range d.Names() {
+			if i > 0 {
+				e.WriteByte(',')
+			}
+			e.field(k, r.ValueOf(d.Fields[k]))
+		}
+		return
+	}
+
+	si := cachedStructInfo(v.Type())
+	if si.class >= 0 {
+		if class := v.Field(si.class).String(); len(class) > 0 {
+			e.WriteString(class)
+			e.WriteByte('@')
+		}
+	}
+	first := true
+	for _, f := range si.fields {
+		fv := v.Field(f.index)
+		if f.omitEmpty && isEmptyValue(fv) {
+			continue
+		}
+		if !first {
+			e.WriteByte(',')
+		}
+		first = false
+		if f.date && fv.Type() == timeType {
+			e.WriteString(f.name)
+			e.WriteByte(':')
+			e.timestamp(fv.Interface().(time.Time), 'a')
+			continue
+		}
+		e.field(f.name, fv)
+	}
+}
+
+// field writes a document field.  Null fields have no value at all.
+func (e *encodeState) field(name string, v r.Value) {
+	e.WriteString(name)
+	e.WriteByte(':')
+	for v.Kind() == r.Ptr || v.Kind() == r.Interface {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+	if v.IsValid() {
+		e.reflectValue(v)
+	}
+}
+
+func isEmptyValue(v r.Value) bool {
+	if v.Type() == timeType {
+		return v.Interface().(time.Time).IsZero()
+	}
+	if v.Type() == dateType {
+		return v.Interface().(Date).IsZero()
+	}
+	switch v.Kind() {
+	case r.Array, r.Map, r.Slice, r.String:
+		return v.Len() == 0
+	case r.Bool:
+		return !v.Bool()
+	case r.Int, r.Int8, r.Int16, r.Int32, r.Int64:
+		return v.Int() == 0
+	case r.Uint, r.Uint8, r.Uint16, r.Uint32, r.Uint64, r.Uintptr:
+		return v.Uint() == 0
+	case r.Float32, r.Float64:
+		return v.Float() == 0
+	case r.Interface, r.Ptr:
+		return v.IsNil()
 	}
+	return false
 }
@@ -1,10 +1,15 @@
 package gorient
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
-//	"reflect"
+	"math"
+	"reflect"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func marsh(t *testing.T, v interface{}, sv string) {
@@ -23,6 +28,7 @@ func TestBasic(t *testing.T) {
 	marsh(t, float32(4.5), "4.5f")
 	marsh(t, float64(4.5), "4.5d")
 	marsh(t, byte(64), "64b")
+	marsh(t, byte(244), "-12b")
 	marsh(t, int16(120), "120s")
 	marsh(t, int32(120), "120")
 	marsh(t, int64(120), "120l")
@@ -41,3 +47,240 @@ func TestMap(t *testing.T) {
 	marsh(t, m, `{"age":32s,"name":"Bob","spouse":"Pat"}`)
 
 }
+
+func TestDocument(t *testing.T) {
+	d := &Document{Class: "Profile", Fields: map[string]interface{}{
+		"nick":    "Neo",
+		"age":     int32(51),
+		"spouse":  nil,
+		"dog":     &Document{Class: "Animal", Fields: map[string]interface{}{"name": "Fido"}},
+		"cat":     Document{Fields: map[string]interface{}{"age": int16(7)}},
+		"aliases": map[string]interface{}{"a": "The One"},
+	}}
+	marsh(t, d, `Profile@age:51,aliases:{"a":"The One"},cat:(age:7s),dog:(Animal@name:"Fido"),nick:"Neo",spouse:`)
+	marsh(t, *d.Fields["dog"].(*Document), `Animal@name:"Fido"`)
+	marsh(t, &Document{}, ``)
+}
+
+func TestStruct(t *testing.T) {
+	type pet struct {
+		Class string `orient:"@class"`
+		Name  string `orient:"name"`
+	}
+	type person struct {
+		Class   string `orient:"@class"`
+		Nick    string `orient:"nick"`
+		Age     int32
+		Title   string `orient:"title,omitempty"`
+		Pet     *pet   `orient:"pet"`
+		Spouse  *pet   `orient:"spouse"`
+		Skip    string `orient:"-"`
+		private int
+	}
+	p := &person{
+		Class: "Person",
+		Nick:  "Neo",
+		Age:   30,
+		Pet:   &pet{"Animal", "Fido"},
+		Skip:  "x",
+	}
+	marsh(t, p, `Person@nick:"Neo",Age:30,pet:(Animal@name:"Fido"),spouse:`)
+
+	p.Class, p.Title, p.Pet.Class = "", "Mr", ""
+	marsh(t, *p, `nick:"Neo",Age:30,title:"Mr",pet:(name:"Fido"),spouse:`)
+
+	var back person
+	b, _ := Marshal(p)
+	if err := Unmarshal(b, &back); err != nil {
+		t.Fatal(err)
+	}
+	p.Skip = ""
+	if !reflect.DeepEqual(&back, p) {
+		t.Errorf("round trip: got %+v, want %+v", back, *p)
+	}
+}
+
+func TestFloat(t *testing.T) {
+	marsh(t, -3.2, "-3.2d")
+	marsh(t, 1e-7, "1E-07d")
+	marsh(t, float32(-1.5e20), "-1.5E+20f")
+	for _, f := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		if _, err := Marshal(f); err == nil {
+			t.Errorf("Marshal(%v): expected error", f)
+		} else if _, ok := err.(*UnsupportedValueError); !ok {
+			t.Errorf("Marshal(%v): got %v", f, err)
+		}
+	}
+	d := parse(`a:-1.5E+20f,b:1E-07d,c:-12b`)
+	b, _ := Marshal(d)
+	if !reflect.DeepEqual(parse(string(b)), d) {
+		t.Errorf("round trip: got %s", b)
+	}
+}
+
+func TestUnsupported(t *testing.T) {
+	for _, v := range []interface{}{
+		map[int]string{1: "a"},
+		make(chan int),
+		&Document{Fields: map[string]interface{}{"f": func() {}}},
+	} {
+		if _, err := Marshal(v); err == nil {
+			t.Errorf("Marshal(%T): expected error", v)
+		} else if _, ok := err.(*UnsupportedTypeError); !ok {
+			t.Errorf("Marshal(%T): got %v", v, err)
+		}
+	}
+}
+
+func TestUnsupportedValue(t *testing.T) {
+	n := &node{}
+	n.Next = n
+	m := map[string]interface{}{}
+	m["m"] = m
+	d := NewDocument("")
+	d.Set("m", m)
+	for _, v := range []interface{}{&unsigned{U64: math.MaxUint64}, n, d} {
+		if _, err := Marshal(v); err == nil {
+			t.Errorf("Marshal(%T): expected error", v)
+		} else if _, ok := err.(*UnsupportedValueError); !ok {
+			t.Errorf("Marshal(%T): got %v", v, err)
+		}
+	}
+
+	in := unsigned{math.MaxUint16, math.MaxUint32, math.MaxInt64}
+	b, err := Marshal(&in)
+	if err != nil || string(b) != "u16:65535,u32:4294967295l,u64:9223372036854775807l" {
+		t.Errorf("got %s, %v", b, err)
+	}
+	var out unsigned
+	if err := Unmarshal(b, &out); err != nil || out != in {
+		t.Errorf("round trip: got %+v, %v", out, err)
+	}
+}
+
+func TestCollections(t *testing.T) {
+	marsh(t, []interface{}{}, `[]`)
+	marsh(t, []int32{1, 2, 3}, `[1,2,3]`)
+	marsh(t, [2]string{"a", "b"}, `["a","b"]`)
+	marsh(t, Set{int16(1), "two", nil}, `<1s,"two",null>`)
+	marsh(t, []interface{}{Set{}, []interface{}{Rid{1, 2}}}, `[<>,[#1:2]]`)
+	marsh(t, Rid{10, 5}, `#10:5`)
+	marsh(t, &Rid{-1, -1}, `#-1:-1`)
+	marsh(t, []byte{0, 1, 2, 3, 4, 5}, `_AAECAwQF_`)
+	marsh(t, []byte{}, `__`)
+	marsh(t, &Document{Fields: map[string]interface{}{
+		"links": []Rid{{10, 5}, {10, 6}},
+		"tags":  Set{"a"},
+		"blob":  []byte("hi"),
+	}}, `blob:_aGk=_,links:[#10:5,#10:6],tags:<"a">`)
+}
+
+// Marshaling a parsed document and parsing the result gives back the
+// same document.
+func TestRoundTrip(t *testing.T) {
+	for _, s := range []string{
+		testrec,
+		`Profile@nick:"B \"POTUS\" Obama",follows:[],followers:[#10:5,#10:6],name:"Barack",age:51,location:#3:2,salary:120.3f,dog:(Animal@name:"Fido"),cat:(name:"Pip",age:7s),x:<1,2>`,
+	} {
+		d := parse(s)
+		b, err := Marshal(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b2, err := Marshal(parse(string(b)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != string(b2) {
+			t.Errorf("round trip of %s:\n%s\n%s", s, b, b2)
+		}
+	}
+}
+
+func TestTime(t *testing.T) {
+	tm := time.Date(2011, 1, 29, 5, 37, 48, 0, time.UTC)
+	marsh(t, tm, "1296279468000t")
+	marsh(t, time.Unix(-1, 5e8), "-500t")
+
+	type event struct {
+		At   time.Time `orient:"at"`
+		On   time.Time `orient:"on,date"`
+		When time.Time `orient:"when,omitempty"`
+	}
+	// The date is taken from the time's own location; 23:00 on the 24th
+	// in New York is the 25th in UTC.
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	ev := event{
+		At: tm,
+		On: time.Date(2011, 5, 24, 23, 0, 0, 0, ny),
+	}
+	marsh(t, ev, "at:1296279468000t,on:1306195200000a")
+	marsh(t, Date{time.Date(2011, 5, 25, 0, 0, 0, 0, time.UTC)}, "1306281600000a")
+
+	// A connection's Location moves dates to midnight there.
+	x := &Xx{Location: ny}
+	var buf bytes.Buffer
+	x.w = bufio.NewWriter(&buf)
+	write, err := x.recordContent(ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write()
+	x.w.Flush()
+	if want := "at:1296279468000t,on:1306209600000a"; buf.String()[4:] != want {
+		t.Errorf("with Location %v: got %q, want %q", ny, buf.Bytes(), want)
+	}
+}
+
+func TestLocation(t *testing.T) {
+	loc := time.FixedZone("UTC+2", 2*60*60)
+	midnight := time.Date(2011, 5, 25, 0, 0, 0, 0, loc)
+	const s = `d:1306274400000a,t:1306281600000t`
+
+	var d Document
+	if err := UnmarshalInLocation([]byte(s), &d, loc); err != nil {
+		t.Fatal(err)
+	}
+	if v := d.Fields["d"].(Date); !v.Equal(midnight) || v.Location() != loc {
+		t.Errorf("UnmarshalInLocation: date %v", v)
+	}
+	if v := d.Fields["t"].(time.Time); v.Location() != loc {
+		t.Errorf("UnmarshalInLocation: datetime %v", v)
+	}
+	dec := NewDecoder(strings.NewReader(s))
+	dec.Location = loc
+	var d2 Document
+	if err := dec.Decode(&d2); err != nil || !reflect.DeepEqual(&d, &d2) {
+		t.Errorf("Decoder: got %v, %v", &d2, err)
+	}
+
+	// A date-tagged time.Time is written as midnight in loc on its own
+	// calendar day.
+	v := struct {
+		D time.Time `orient:"d,date"`
+	}{time.Date(2011, 5, 25, 23, 0, 0, 0, time.UTC)}
+	if b, err := MarshalInLocation(&v, loc); err != nil || string(b) != "d:1306274400000a" {
+		t.Errorf("MarshalInLocation: got %s, %v", b, err)
+	}
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.Location = loc
+	if err := enc.Encode(&v); err != nil || buf.String() != "d:1306274400000a" {
+		t.Errorf("Encoder: got %s, %v", buf.Bytes(), err)
+	}
+
+	b, err := MarshalBinaryInLocation(&d, loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var d3 Document
+	if err := UnmarshalBinaryInLocation(b, &d3, loc); err != nil {
+		t.Fatal(err)
+	}
+	if v := d3.Fields["d"].(Date); !v.Equal(midnight) || v.Location() != loc {
+		t.Errorf("binary: date %v", v)
+	}
+}
@@ -0,0 +1,128 @@
+package gorient
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// classTag is the tag name that marks the string field holding a
+// document's class, eg.
+//
+//	type Profile struct {
+//		Class string `orient:"@class"`
+//		Nick  string `orient:"nick"`
+//	}
+const classTag = "@class"
+
+// field describes a struct field that maps to a document field.
+type field struct {
+	name      string
+	index     int
+	typ       reflect.Type
+	omitEmpty bool
+	date      bool // time.Time field holding a date rather than a datetime
+}
+
+// structInfo is the document layout of a struct type.
+type structInfo struct {
+	fields []field
+	byName map[string]int // index into fields
+	class  int            // struct field index of the @class field, or -1
+}
+
+var structCache struct {
+	sync.RWMutex
+	m map[reflect.Type]*structInfo
+}
+
+// cachedStructInfo returns the layout of struct type t, computing it on
+// first use.
+func cachedStructInfo(t reflect.Type) *structInfo {
+	structCache.RLock()
+	si := structCache.m[t]
+	structCache.RUnlock()
+	if si != nil {
+		return si
+	}
+
+	si = typeStructInfo(t)
+	structCache.Lock()
+	if structCache.m == nil {
+		structCache.m = make(map[reflect.Type]*structInfo)
+	}
+	structCache.m[t] = si
+	structCache.Unlock()
+	return si
+}
+
+func typeStructInfo(t reflect.Type) *structInfo {
+	si := &structInfo{byName: make(map[string]int), class: -1}
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" { // unexported
+			continue
+		}
+		tag := sf.Tag.Get("orient")
+		if tag == "-" {
+			continue
+		}
+		name, opts := parseTag(tag)
+		if name == classTag {
+			if sf.Type.Kind() == reflect.String {
+				si.class = i
+			}
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		si.byName[name] = len(si.fields)
+		si.fields = append(si.fields, field{
+			name:      name,
+			index:     i,
+			typ:       sf.Type,
+			omitEmpty: opts.contains("omitempty"),
+			date:      opts.contains("date"),
+		})
+	}
+	return si
+}
+
+// lookup finds the field for a document field name, falling back to a
+// case-insensitive match.
+func (si *structInfo) lookup(name string) *field {
+	if i, ok := si.byName[name]; ok {
+		return &si.fields[i]
+	}
+	for i := range si.fields {
+		if strings.EqualFold(si.fields[i].name, name) {
+			return &si.fields[i]
+		}
+	}
+	return nil
+}
+
+type tagOptions string
+
+func parseTag(tag string) (string, tagOptions) {
+	if i := strings.IndexByte(tag, ','); i >= 0 {
+		return tag[:i], tagOptions(tag[i+1:])
+	}
+	return tag, ""
+}
+
+func (o tagOptions) contains(name string) bool {
+	s := string(o)
+	for s != "" {
+		var next string
+		if i := strings.IndexByte(s, ','); i >= 0 {
+			s, next = s[:i], s[i+1:]
+		}
+		if s == name {
+			return true
+		}
+		s = next
+	}
+	return false
+}
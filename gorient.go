@@ -1,8 +1,17 @@
 package gorient
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
 	"encoding/binary"
 )
 
@@ -67,17 +76,263 @@ const (
 	// CONSTANTS
 	RECORD_NULL              int16 = -2
 	RECORD_RID               int16 = -3
-	CURRENT_PROTOCOL_VERSION int16 = 15
+	CURRENT_PROTOCOL_VERSION int16 = 28
 )
 
+// Xx is a connection to a database.  It is safe for concurrent use:
+// requests are serialized, each holding the connection from the start
+// of the request until its response has been read.
+//
+// An error other than one reported by the server (a *ServerError) can
+// leave a response half read, so it closes the connection, and every
+// later request fails with the same error.  The same goes for a
+// request cut short by its context (see doContext).  With Reconnect
+// set, the next request dials again instead.
 type Xx struct {
+	// Serializer is the format of record content, set before the
+	// database is opened.  The default is the record string format.
+	Serializer Serializer
+
+	// Location is the time zone of the database server, where dates
+	// are midnight; datetimes are decoded in it too.  Nil means UTC.
+	Location *time.Location
+
+	// Reconnect, set before the database is opened with open, makes a
+	// request that finds the connection broken dial the server again
+	// and re-open the database, authenticating afresh, before it is
+	// sent.  A request that reads records, or size or count, is also
+	// retried once on a new connection if the old one failed before
+	// any of its response arrived (as when the server has restarted).
+	// Requests that write are not, in case the server carried them out.
+	Reconnect bool
+
+	// Dialer, if set, opens the connection for open instead of a
+	// net.Dialer.  TLS, if set, secures it: client certificates go in
+	// Certificates, and custom root CAs in RootCAs.  The server's
+	// certificate is checked against ServerName, or the host dialed if
+	// that is empty.
+	Dialer Dialer
+	TLS *tls.Config
+
+	mu sync.Mutex
 	conn net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
 	sess int32
-	proto int16
+	proto *protocol
+	err error // set once the connection is unusable
+	inResp bool // the response to the current request has begun
+
+	// For reconnecting: how to dial the server, and the database and
+	// credentials it was opened with
+	dial func(context.Context) (net.Conn, error)
+	db, user, pass string
+
+	// The session token, with protocol 26 or later.  It is sent with
+	// each request, and the server may renew it in a response.
+	token []byte
+
+	// From DB_OPEN
+	clusters []cluster
+	release string
+
+	// Server pushes (see push.go)
+	pushes []push
+	delivering bool
+	recordPush func(Record)
+	configPush func(*Document)
+}
+
+var errClosed = errors.New("gorient: connection closed")
+
+// ErrDesync is reported (wrapped) when a response doesn't fit the
+// request; the connection is closed.
+var ErrDesync = errors.New("gorient: protocol desync")
+
+// A ServerError is an error reported by the server in response to a
+// request.  The connection remains usable.
+type ServerError struct {
+	Exceptions []Exception
+}
+
+// Exception is one (Java) exception in a ServerError; the first is the
+// outermost, the rest are its causes.
+type Exception struct {
+	Class   string
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	msgs := make([]string, len(e.Exceptions))
+	for i, ex := range e.Exceptions {
+		msgs[i] = ex.Class + ": " + ex.Message
+	}
+	return "gorient: server error: " + strings.Join(msgs, "; caused by ")
+}
+
+// An AbortedError is left on a connection when a context ended one of
+// its requests part way through; the rest of the response was never
+// read, so the connection is closed.
+type AbortedError struct {
+	Err error // the context's error
+}
+
+func (e *AbortedError) Error() string {
+	return "gorient: connection closed after aborted request: " + e.Err.Error()
+}
+
+// do runs one request/response exchange f while holding the connection.
+// The request methods panic on errors, and do returns them.
+func (x *Xx) do(f func()) error {
+	return x.doContext(context.Background(), f)
+}
+
+// doContext is do with the context's deadline applied to the
+// connection.  If the context is done while f is reading or writing,
+// the connection is closed and the context's error is returned.
+func (x *Xx) doContext(ctx context.Context, f func()) error {
+	return x.run(ctx, false, f)
+}
+
+// doRetry is doContext for requests that can safely be sent twice: one
+// that fails before its response starts is retried on a new connection,
+// if Reconnect is set.
+func (x *Xx) doRetry(ctx context.Context, f func()) error {
+	return x.run(ctx, true, f)
+}
+
+func (x *Xx) run(ctx context.Context, retry bool, f func()) error {
+	defer x.deliverPushes()
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.err != nil && !x.canReconnect() {
+		return x.err
+	}
+	if err := ctx.Err(); err != nil {
+		// Nothing sent; the connection is still usable.
+		return err
+	}
+	if x.err != nil {
+		if err := x.reconnect(ctx); err != nil {
+			return err
+		}
+	}
+	err := x.exchange(ctx, f)
+	if err != nil && retry && x.err == err && !x.inResp && x.canReconnect() {
+		if err := x.reconnect(ctx); err != nil {
+			return err
+		}
+		err = x.exchange(ctx, f)
+	}
+	return err
+}
+
+// exchange runs f, recovering the errors it panics.  Any error but a
+// *ServerError closes the connection.
+func (x *Xx) exchange(ctx context.Context, f func()) (err error) {
+	x.inResp = false
+	defer func() {
+		if e := recover(); e != nil {
+			if _, ok := e.(runtime.Error); ok {
+				panic(e)
+			}
+			var ok bool
+			if err, ok = e.(error); !ok {
+				err = fmt.Errorf("gorient: %v", e)
+			}
+			if _, ok := err.(*ServerError); ok {
+				return
+			}
+			if cerr := contextError(ctx, err); cerr != nil {
+				err = cerr
+				x.err = &AbortedError{cerr}
+			} else {
+				x.err = err
+			}
+			x.conn.Close()
+		}
+	}()
+	if d, ok := ctx.Deadline(); ok {
+		x.conn.SetDeadline(d)
+	}
+	if ctx.Done() != nil {
+		// Cancellation sets a deadline in the past, failing any read
+		// or write in progress; that I/O error panics and breaks the
+		// connection below.  A cancellation that comes after the last
+		// read leaves the connection in step, and only the deadline
+		// needs clearing.
+		stop, done := make(chan struct{}), make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				x.conn.SetDeadline(time.Unix(1, 0))
+			case <-stop:
+			}
+			close(done)
+		}()
+		defer func() {
+			close(stop)
+			<-done
+			x.conn.SetDeadline(time.Time{})
+		}()
+	}
+	f()
+	return nil
+}
+
+func (x *Xx) canReconnect() bool {
+	return x.Reconnect && x.dial != nil && x.err != errClosed
+}
+
+// reconnect replaces the broken connection with a new one and re-opens
+// the database on it.  If that fails, the connection stays broken and
+// the next request tries again.
+func (x *Xx) reconnect(ctx context.Context) error {
+	conn, err := x.dial(ctx)
+	if err != nil {
+		return err
+	}
+	x.reset(conn)
+	err = x.exchange(ctx, func() { x.openDB(x.db, x.user, x.pass) })
+	if err != nil && x.err == nil {
+		// Refused by the server
+		x.err = err
+		conn.Close()
+	}
+	return err
+}
+
+// reset starts over on a new connection, without a session.
+func (x *Xx) reset(conn net.Conn) {
+	x.conn = conn
+	x.r = bufio.NewReader(conn)
+	x.w = bufio.NewWriter(conn)
+	x.sess = -1
+	x.token = nil
+	x.err = nil
+}
+
+// contextError returns the context error responsible for err, if any.
+func contextError(ctx context.Context, err error) error {
+	if cerr := ctx.Err(); cerr != nil {
+		return cerr
+	}
+	if _, ok := ctx.Deadline(); ok && errors.Is(err, os.ErrDeadlineExceeded) {
+		// The connection's deadline can pass just before the context's.
+		return context.DeadlineExceeded
+	}
+	return nil
+}
+
+// broken reports whether an error has left the connection unusable.
+func (x *Xx) broken() bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.err != nil
 }
 
 func (x *Xx) read(data interface{}) {
-	err := binary.Read(x.conn, binary.BigEndian, data)
+	err := binary.Read(x.r, binary.BigEndian, data)
 	if err != nil { panic(err) }
 }
 
@@ -86,14 +341,14 @@ func (x *Xx) write(data ...interface{}) {
 	for _, d := range data {
 		switch d.(type) {
 		case string:
-			b := []byte(d.(string))
-			err = binary.Write(x.conn, binary.BigEndian, int32(len(b)))
+			s := d.(string)
+			err = binary.Write(x.w, binary.BigEndian, int32(len(s)))
 			if err != nil {
 				panic(err)
 			}
-			err = binary.Write(x.conn, binary.BigEndian, &b)
+			_, err = x.w.WriteString(s)
 		default:
-			err = binary.Write(x.conn, binary.BigEndian, d)
+			err = binary.Write(x.w, binary.BigEndian, d)
 		}
 		if err != nil {
 			panic(err)
@@ -138,26 +393,48 @@ func (x *Xx) readRid() Rid {
 }
 func (x *Xx) beginReq(command Command) {
 	x.write(command, x.sess)
+	if x.token != nil {
+		x.write(int32(len(x.token)), x.token)
+	}
+}
+
+// endReq sends the buffered request.
+func (x *Xx) endReq() {
+	if err := x.w.Flush(); err != nil {
+		panic(err)
+	}
 }
 func (x *Xx) beginResp() {
 	err := x.readByte()
+	x.inResp = true
+	for err == PUSH_DATA {
+		x.readPush()
+		err = x.readByte()
+	}
 
-	// TODO: sess != x.sess
-	x.readInt32()
-
-	if err == 1 {
-		// TODO: proper error handling
-		fmt.Println("ERROR")
-		x.readErrors()
-		panic("Transaction failed")
+	// A response for another session means we've lost track of where
+	// the responses begin and end.
+	if sess := x.readInt32(); sess != x.sess {
+		panic(fmt.Errorf("%w: response for session %d, expected %d", ErrDesync, sess, x.sess))
+	}
+	if x.token != nil {
+		// An empty token means it hasn't changed.
+		if t := x.readBytes(); len(t) > 0 {
+			x.token = t
+		}
 	}
 
+	if err == STATUS_ERROR {
+		panic(x.readErrors())
+	}
 }
 
-func (x *Xx) readErrors() {
+func (x *Xx) readErrors() *ServerError {
+	e := &ServerError{}
 	for x.readByte() == 1 {
-		fmt.Println(x.readString(),	x.readString())
+		e.Exceptions = append(e.Exceptions, Exception{x.readString(), x.readString()})
 	}
+	return e
 }
 
 type cluster struct {
@@ -168,67 +445,131 @@ type cluster struct {
 }
 
 func (x *Xx) open(host, db, user, pass string) error {
-	conn, err := net.Dial("tcp", host)
+	return x.openContext(context.Background(), host, db, user, pass)
+}
+
+// openContext is open with the deadline and cancellation of ctx.
+func (x *Xx) openContext(ctx context.Context, host, db, user, pass string) error {
+	dial := x.dialFunc(host)
+	conn, err := dial(ctx)
 	if err != nil {
-		fmt.Println("failed to connect:",err)
 		return err
 	}
-	x.conn = conn
-	x.sess = -1
+	if err := x.openConnContext(ctx, conn, db, user, pass); err != nil {
+		return err
+	}
+	x.dial = dial
+	return nil
+}
 
-	// Server sends protocol on connect
-	x.proto = x.readInt16()
+// openConn opens database db over an established connection.
+func (x *Xx) openConn(conn net.Conn, db, user, pass string) error {
+	return x.openConnContext(context.Background(), conn, db, user, pass)
+}
 
-	if x.proto < 13 || x.proto > 15 {
-		fmt.Println("Unrecognized protocol:",x.proto,
-			"Continuing anyway.")
+func (x *Xx) openConnContext(ctx context.Context, conn net.Conn, db, user, pass string) error {
+	x.reset(conn)
+	x.dial = nil
+	x.db, x.user, x.pass = db, user, pass
+	err := x.doContext(ctx, func() { x.openDB(db, user, pass) })
+	if err != nil {
+		x.close()
 	}
+	return err
+}
 
-	fmt.Println("db protocol:",x.proto)
+func (x *Xx) openDB(db, user, pass string) {
+	// Server sends protocol on connect
+	p, err := negotiate(x.readInt16())
+	if err != nil {
+		panic(err)
+	}
+	x.proto = p
 
 	x.beginReq(DB_OPEN)
-	x.write("gorient", "alpha", x.proto, "a client id")
+	x.write("gorient", "alpha", p.version, "a client id")
+	if p.serializer {
+		x.write(x.Serializer.name())
+	} else if x.Serializer != SerializerCSV {
+		panic(fmt.Errorf("gorient: %s needs protocol 22, server has %d", x.Serializer.name(), p.version))
+	}
+	if p.tokenSession {
+		x.write(byte(1)) // ask for a token
+	}
 	x.write(db, "document", user, pass)
+	x.endReq()
 
 	x.beginResp()
 	x.read(&x.sess)
+	if p.tokenSession {
+		if t := x.readBytes(); len(t) > 0 {
+			x.token = t
+		}
+	}
 
-	var cc int16
-	x.read(&cc)
-	fmt.Println("cluster count:",cc)
-
-	cs := make([]cluster, cc)
+	cs := make([]cluster, x.readInt16())
 	for i := range cs {
 		c := &cs[i]
 		c.name = x.readString()
 		x.read(&c.id)
-		c.typ = x.readString()
-		x.read(&c.segId)
+		if p.clusterType {
+			c.typ = x.readString()
+			x.read(&c.segId)
+		}
 	}
-	fmt.Println("cconfig:",x.readBytes())
-	if x.proto >= 14 {
-		fmt.Println("v:",x.readString())
+	x.clusters = cs
+	x.readBytes() // cluster config, null unless the server is distributed
+	if p.release {
+		x.release = x.readString()
 	}
-	return nil
 }
 
 func (x *Xx) close() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
 	// TODO: DB_CLOSE
+	if x.err == nil {
+		x.err = errClosed
+	}
 	return x.conn.Close()
 }
 
-func (x *Xx) size() int64 {
-	x.beginReq(DB_SIZE)
-	x.beginResp()
-	return x.readInt64()
+func (x *Xx) size() (int64, error) {
+	return x.sizeContext(context.Background())
 }
 
-func (x *Xx) recordCount() int64 {
-	x.beginReq(DB_COUNTRECORDS)
-	x.beginResp()
-	return x.readInt64()
+// sizeContext is size with the deadline and cancellation of ctx.
+func (x *Xx) sizeContext(ctx context.Context) (n int64, err error) {
+	err = x.doRetry(ctx, func() {
+		x.beginReq(DB_SIZE)
+		x.endReq()
+		x.beginResp()
+		n = x.readInt64()
+	})
+	return
+}
+
+func (x *Xx) recordCount() (n int64, err error) {
+	err = x.doRetry(context.Background(), func() {
+		x.beginReq(DB_COUNTRECORDS)
+		x.endReq()
+		x.beginResp()
+		n = x.readInt64()
+	})
+	return
 }
-func (x *Xx) loadRecord(rid Rid, plan string) (Record, map[Rid]Record)  {
+
+func (x *Xx) loadRecord(rid Rid, plan string) (Record, map[Rid]Record, error) {
+	return x.loadRecordContext(context.Background(), rid, plan)
+}
+
+// loadRecordContext is loadRecord with the deadline and cancellation of ctx.
+func (x *Xx) loadRecordContext(ctx context.Context, rid Rid, plan string) (rec Record, pres map[Rid]Record, err error) {
+	err = x.doRetry(ctx, func() { rec, pres = x.load(rid, plan) })
+	return
+}
+
+func (x *Xx) load(rid Rid, plan string) (Record, map[Rid]Record) {
 	x.beginReq(RECORD_LOAD)
 	x.write(rid)
 
@@ -236,11 +577,16 @@ func (x *Xx) loadRecord(rid Rid, plan string) (Record, map[Rid]Record)  {
 	// See https://github.com/nuvolabase/orientdb/wiki/Fetching-Strategies
 	x.write(plan)
 
-	// Ignore cache, don't load tombstones (?)
-	x.write(byte(1), byte(0))
+	// Ignore cache, don't load tombstones
+	x.write(byte(1))
+	if x.proto.tombstones {
+		x.write(byte(0))
+	}
+	x.endReq()
 
 	x.beginResp()
 	// Response: [(payload-status:byte)[(rec-content:bytes)(rec-ver:int)(rec-type:byte)]*]+
+	// or, from protocol 28, [(payload-status:byte)[(rec-type:byte)(rec-ver:int)(rec-content:bytes)]*]+
 
 	var pres map[Rid]Record
 	var rec Record
@@ -248,10 +594,19 @@ func (x *Xx) loadRecord(rid Rid, plan string) (Record, map[Rid]Record)  {
 	for {
 		switch stat := x.readByte(); stat {
 		case 1:
-			content := x.readBytes()
-			ver := x.readInt32()
-			rtype := x.readByte()
-			rec = Record{ver, recValue(rtype, content)}
+			var rtype byte
+			var ver int32
+			var content []byte
+			if x.proto.loadTypeFirst {
+				rtype = x.readByte()
+				ver = x.readInt32()
+				content = x.readBytes()
+			} else {
+				content = x.readBytes()
+				ver = x.readInt32()
+				rtype = x.readByte()
+			}
+			rec = Record{rid, ver, x.recValue(rtype, content)}
 
 		case 2:
 			// Next record is a cache pre-fetch, to be loaded
@@ -259,20 +614,138 @@ func (x *Xx) loadRecord(rid Rid, plan string) (Record, map[Rid]Record)  {
 			if pres == nil {
 				pres = make(map[Rid]Record, 1)
 			}
-			id, r := x.readRecord()
-			pres[id] = r
+			r := x.readRecord()
+			pres[r.Rid] = r
 
 		case 0:
 			return rec, pres
 
 		default:
-			panic(fmt.Sprintf("Unrecognized payload status: %s\n", string(stat)))
+			panic(fmt.Errorf("gorient: unrecognized payload status: %d", stat))
+		}
+	}
+}
+
+// writeRecord writes v as record content of length n (from encodedLen):
+// the length followed by the encoding, straight into the request buffer.
+func (x *Xx) writeRecord(v interface{}, n int) {
+	x.write(int32(n))
+	enc := NewEncoder(x.w)
+	enc.Location = x.Location
+	if err := enc.Encode(v); err != nil {
+		panic(err)
+	}
+}
+
+// recordContent checks v can be encoded before a request starts, and
+// returns a function that writes it as record content in the
+// connection's format.
+func (x *Xx) recordContent(v interface{}) (func(), error) {
+	if x.Serializer == SerializerBinary {
+		b, err := MarshalBinaryInLocation(v, x.Location)
+		if err != nil {
+			return nil, err
+		}
+		return func() { x.write(int32(len(b)), b) }, nil
+	}
+	n, err := encodedLen(v, x.Location)
+	if err != nil {
+		return nil, err
+	}
+	return func() { x.writeRecord(v, n) }, nil
+}
+
+// readCollectionChanges skips the link bag changes at the end of a
+// create or update response; nothing here caches link bag trees.
+func (x *Xx) readCollectionChanges() {
+	for n := x.readInt32(); n > 0; n-- {
+		// (uuid-most:long)(uuid-least:long)(file-id:long)(page-index:long)(page-offset:int)
+		x.readInt64()
+		x.readInt64()
+		x.readInt64()
+		x.readInt64()
+		x.readInt32()
+	}
+}
+
+// createRecord stores the document v (a *Document or a struct) as a new
+// record in cluster, returning its id and version.
+func (x *Xx) createRecord(cluster int16, v interface{}) (Rid, int32, error) {
+	return x.createRecordContext(context.Background(), cluster, v)
+}
+
+// createRecordContext is createRecord with the deadline and cancellation of ctx.
+func (x *Xx) createRecordContext(ctx context.Context, cluster int16, v interface{}) (rid Rid, ver int32, err error) {
+	content, err := x.recordContent(v)
+	if err != nil {
+		return
+	}
+	err = x.doContext(ctx, func() {
+		x.beginReq(RECORD_CREATE)
+		// Request: (datasegment-id:int)(cluster-id:short)(record-content:bytes)
+		//          (record-type:byte)(mode:byte)
+		// A datasegment id of -1 selects the default segment; mode 0 is
+		// synchronous.
+		if x.proto.dataSegment {
+			x.write(int32(-1))
+		}
+		x.write(cluster)
+		content()
+		x.write(byte('d'), byte(0))
+		x.endReq()
+
+		x.beginResp()
+		// Response: (cluster-id:short)(cluster-position:long)(record-version:int)
+		//           (collection-changes)
+		rid.Cluster = cluster
+		if x.proto.createClusterId {
+			rid.Cluster = x.readInt16()
 		}
+		rid.Position = x.readInt64()
+		ver = x.readInt32()
+		if x.proto.collectionChanges {
+			x.readCollectionChanges()
+		}
+	})
+	return
+}
+
+// updateRecord replaces the content of record rid with the document v,
+// returning the new version.  version must be the record's current
+// version, or -1 to overwrite whatever is there.
+func (x *Xx) updateRecord(rid Rid, v interface{}, version int32) (int32, error) {
+	return x.updateRecordContext(context.Background(), rid, v, version)
+}
+
+// updateRecordContext is updateRecord with the deadline and cancellation of ctx.
+func (x *Xx) updateRecordContext(ctx context.Context, rid Rid, v interface{}, version int32) (ver int32, err error) {
+	content, err := x.recordContent(v)
+	if err != nil {
+		return
 	}
-	panic("")
+	err = x.doContext(ctx, func() {
+		x.beginReq(RECORD_UPDATE)
+		// Request: (cluster-id:short)(cluster-position:long)(update-content:byte)
+		//          (record-content:bytes)(record-version:int)(record-type:byte)(mode:byte)
+		x.write(rid)
+		if x.proto.updateContent {
+			x.write(byte(1))
+		}
+		content()
+		x.write(version, byte('d'), byte(0))
+		x.endReq()
+
+		x.beginResp()
+		// Response: (record-version:int)(collection-changes)
+		ver = x.readInt32()
+		if x.proto.collectionChanges {
+			x.readCollectionChanges()
+		}
+	})
+	return
 }
 
-func (x *Xx) readRecord() (Rid, Record) {
+func (x *Xx) readRecord() Record {
 	// Null:(-2:short)
 	// RID: (-3:short)(cluster:short)(position:long)
 	// Rec:  (0:short)(rectype:byte)(clus:short)(pos:long)(ver:int)(content:bytes)
@@ -284,28 +757,37 @@ func (x *Xx) readRecord() (Rid, Record) {
 		rid := x.readRid()
 		ver := x.readInt32()
 		content := x.readBytes()
-		return rid, Record{ver, recValue(rtype, content)}
-	case -2:
-		// TODO
-		panic("null record")
-	case -3:
-		rid := x.readRid()
-		fmt.Println("RID sub:",rid)
-		// TODO
-		panic("RID record")
+		return Record{rid, ver, x.recValue(rtype, content)}
+	case RECORD_NULL:
+		return Record{Rid: NewRid}
+	case RECORD_RID:
+		// Just the id of a record that wasn't loaded
+		return Record{Rid: x.readRid()}
 	}
-	// TODO
-	panic(fmt.Sprintf("Unrecognized record type: %v\n", rtype))
+	panic(fmt.Errorf("gorient: unrecognized record type: %d", rtype))
 }
-func recValue(rtype byte, content []byte) interface{} {
+func (x *Xx) recValue(rtype byte, content []byte) interface{} {
 	switch rtype {
-	case 'd':     return parse(string(content))
+	case 'd':     return x.document(content)
 	case 'b','f': return content
 	}
-	panic(fmt.Sprintf("Unrecognized record format: %v",rtype))
+	panic(fmt.Errorf("gorient: unrecognized record format: %d", rtype))
 }
 
 
+// document decodes document content in the connection's format.
+func (x *Xx) document(content []byte) *Document {
+	dec := decode
+	if x.Serializer == SerializerBinary {
+		dec = decodeBinary
+	}
+	d, err := dec(content, nil, nil, x.Location)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
 // Execute a command string (ie. a query or script)
 //
 // class:
@@ -327,7 +809,40 @@ func recValue(rtype byte, content []byte) interface{} {
 //
 //  'a' streams back records one at a time
 //  's' packages records with a leading record count
-func (x *Xx) command(q, class string, mode byte, lim int, fp string) {
+func (x *Xx) command(q, class string, mode byte, lim int, fp string) (*ResultSet, error) {
+	return x.commandContext(context.Background(), q, class, mode, lim, fp)
+}
+
+// commandContext is command with the deadline and cancellation of ctx.
+func (x *Xx) commandContext(ctx context.Context, q, class string, mode byte, lim int, fp string) (rs *ResultSet, err error) {
+	f := func() { rs = x.cmd(q, class, mode, lim, fp) }
+	if class == "q" {
+		// Synchronous queries only read.
+		err = x.doRetry(ctx, f)
+	} else {
+		err = x.doContext(ctx, f)
+	}
+	return
+}
+
+// commandFunc runs a command as command does, then calls fn with each
+// result record, stopping at the first error fn returns.  fn is called
+// after the connection has been released, so it may make requests of
+// its own.
+func (x *Xx) commandFunc(q, class string, mode byte, lim int, fp string, fn func(Record) error) error {
+	rs, err := x.command(q, class, mode, lim, fp)
+	if err != nil {
+		return err
+	}
+	for _, r := range rs.Records {
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (x *Xx) cmd(q, class string, mode byte, lim int, fp string) *ResultSet {
 
 	// NOTE: The orientdb network protocol docs seem to be wrong here.
 	//  Should be:
@@ -351,10 +866,12 @@ func (x *Xx) command(q, class string, mode byte, lim int, fp string) {
 	plen += 4 + len(fp)
 	plen += 4 // params (0:int for now)
 
-	x.write(mode, int32(plen), class, q, int32(2), fp, int32(0))
+	x.write(mode, int32(plen), class, q, int32(lim), fp, int32(0))
+	x.endReq()
 
 	x.beginResp()
 
+	rs := &ResultSet{}
 	if mode == 's' {
 		stat := x.readByte()
 		switch stat {
@@ -362,38 +879,46 @@ func (x *Xx) command(q, class string, mode byte, lim int, fp string) {
 			// (c:int)[(record)]{c}
 
 			c := x.readInt32()
+			rs.Records = make([]Record, 0, c)
 			for c > 0 {
-				id, r := x.readRecord()
-				fmt.Println("lrecord",c,":",id,r)
+				rs.Records = append(rs.Records, x.readRecord())
 				c--
 			}
 		case 'r':
-			id, r := x.readRecord()
-			fmt.Println("rrecord:",id,r)
+			rs.Records = []Record{x.readRecord()}
 		case 'a':
 			// (value:string/bytes)
-			fmt.Println(x.readString())
+			rs.Records = []Record{{Rid: NewRid, Value: x.readString()}}
 		case 'n':
-			fmt.Println("null record")
+			// null result
+		default:
+			panic(fmt.Errorf("gorient: unrecognized result type: %d", stat))
 		}
-
-		return
+		if !x.proto.commandPrefetch {
+			return rs
+		}
+		// [(2:byte)(record)]*(0:byte)
 	}
 
 	for {
 		stat := x.readByte()
 		switch stat {
 		case 1:
-			id, r := x.readRecord()
-			fmt.Println("1record:",id,r)
+			if mode == 's' {
+				panic(fmt.Errorf("gorient: unrecognized payload status: %d", stat))
+			}
+			rs.Records = append(rs.Records, x.readRecord())
 		case 2:
-			id, r := x.readRecord()
-			fmt.Println("2record:",id,r)
+			// Prefetched record, as for loadRecord
+			if rs.Prefetch == nil {
+				rs.Prefetch = make(map[Rid]Record, 1)
+			}
+			r := x.readRecord()
+			rs.Prefetch[r.Rid] = r
 		case 0:
-			return
+			return rs
 		default:
-			return
+			panic(fmt.Errorf("gorient: unrecognized payload status: %d", stat))
 		}
 	}
-
 }
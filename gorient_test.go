@@ -14,9 +14,11 @@ func TestX(t *testing.T) {
 	}
 	defer x.close()
 
-	fmt.Println(x)
-	fmt.Println("size:", x.size())
-	fmt.Println("records:", x.recordCount())
+	fmt.Println(&x)
+	n, err := x.size()
+	fmt.Println("size:", n, err)
+	n, err = x.recordCount()
+	fmt.Println("records:", n, err)
 
 //	x.command("create class testx", "c", 's', -1, "")
 //	x.command("drop class testx", "c", 's', -1, "")
@@ -1,6 +1,7 @@
 package gorient
 
 import (
+	"bytes"
 	"fmt"
 	"strings"
 	"unicode"
@@ -73,46 +74,57 @@ const eof = -1
 
 type item struct {
 	typ itemType
-	val string
+	pos int    // byte offset of the item in the input
+	val []byte // item text, or the message of an error item
 }
 
 func (i *item) String() string {
 	return fmt.Sprintf("%s (%s)", i.val, i.typ)
 }
+// lexer scans the record string format.  It is driven by its caller:
+// each call to nextItem runs the state functions until one of them has
+// emitted an item.
 type lexer struct {
-	input string
-	start int
-	pos   int
-	width int
-	state stateFn
-	items chan item
+	input   []byte
+	start   int
+	pos     int
+	width   int
+	state   stateFn
+	item    item // the most recently emitted item
+	emitted bool
 }
 type stateFn func(*lexer) stateFn
 
-func lex(input string) (*lexer, chan item) {
-	l := &lexer{
+func lex(input []byte) *lexer {
+	return &lexer{
 		input: input,
-		items: make(chan item, 10),
+		state: lexValue,
 	}
-	go l.run()
-	return l, l.items
 }
 
-func (l *lexer) run() {
-	for state := lexValue; state != nil; {
-		state = state(l)
+// nextItem returns the next item from the input.  Once lexing has ended,
+// whether at the end of the document or on an error, it returns an
+// error item.
+func (l *lexer) nextItem() item {
+	l.emitted = false
+	for l.state != nil {
+		l.state = l.state(l)
+		if l.emitted {
+			return l.item
+		}
 	}
-	close(l.items)
+	return item{itemError, len(l.input), []byte("unexpected end of input")}
 }
 
 func (l *lexer) errorf(format string, args ...interface{}) stateFn {
-	l.items <- item{itemError, fmt.Sprintf(format, args...)}
+	l.item = item{itemError, l.start, []byte(fmt.Sprintf(format, args...))}
+	l.emitted = true
 	return nil
 }
 
 func (l *lexer) emit(t itemType) {
-	it := item{t, l.input[l.start:l.pos]}
-	l.items <- it
+	l.item = item{t, l.start, l.input[l.start:l.pos]}
+	l.emitted = true
 	l.start = l.pos
 }
 
@@ -130,7 +142,7 @@ func (l *lexer) next() (r rune) {
 		l.width = 0
 		return eof
 	}
-	r, l.width = utf8.DecodeRuneInString(l.input[l.pos:])
+	r, l.width = utf8.DecodeRune(l.input[l.pos:])
 	l.pos += l.width
 	return r
 }
@@ -170,6 +182,11 @@ func lexValue(l *lexer) stateFn {
 		return lexBinary
 	case '#':
 		return lexRID
+	case '-', '+', '.':
+		if r := l.peek(); unicode.IsDigit(r) || (r == '.' && c != '.') {
+			return lexNumber
+		}
+		return l.errorf("unrecognized character %q", c)
 	case eof, ' ':
 		l.emit(itemEndDoc)
 		return nil
@@ -180,10 +197,9 @@ func lexValue(l *lexer) stateFn {
 		case unicode.IsLetter(c):
 			return lexSymbol
 		default:
-			fmt.Printf("unrecognized lexeme start character: %s (%v)\n", string(c), c)
+			return l.errorf("unrecognized character %q", c)
 		}
 	}
-	return nil
 }
 func emitNum(l *lexer, i itemType) stateFn {
 	l.backup()
@@ -191,12 +207,42 @@ func emitNum(l *lexer, i itemType) stateFn {
 	l.eat(1)
 	return lexValue
 }
+// accept consumes the next rune if it's from the valid set.
+func (l *lexer) accept(valid string) bool {
+	if strings.IndexRune(valid, l.next()) >= 0 {
+		return true
+	}
+	l.backup()
+	return false
+}
+
+// acceptRun consumes a run of runes from the valid set, reporting
+// whether there were any.
+func (l *lexer) acceptRun(valid string) bool {
+	n := 0
+	for strings.IndexRune(valid, l.next()) >= 0 {
+		n++
+	}
+	l.backup()
+	return n > 0
+}
+
+// lexNumber scans a number, which may have a sign, a fraction and an
+// exponent (as Java writes them, eg. "-1.0E-7d"), followed by an
+// optional type suffix.  The sign or first digit has been consumed.
 func lexNumber(l *lexer) stateFn {
-	r := l.next()
-	for unicode.IsDigit(r) || r == '.' {
-		r = l.next()
+	const digits = "0123456789"
+	l.acceptRun(digits)
+	if l.accept(".") {
+		l.acceptRun(digits)
+	}
+	if l.accept("eE") {
+		l.accept("+-")
+		if !l.acceptRun(digits) {
+			return l.errorf("malformed number")
+		}
 	}
-	switch r {
+	switch r := l.next(); r {
 	case 'b': return emitNum(l, itemByte)
 	case 's': return emitNum(l, itemShort)
 	case 'l': return emitNum(l, itemLong)
@@ -210,11 +256,10 @@ func lexNumber(l *lexer) stateFn {
 		l.emit(itemInt)
 		return lexValue
 	}
-	return nil
 }
 
 func lexRID(l *lexer) stateFn {
-	for r := l.next(); unicode.IsDigit(r) || r == ':'; r = l.next() {}
+	for r := l.next(); unicode.IsDigit(r) || r == ':' || r == '-'; r = l.next() {}
 	l.backup()
 	l.emit(itemRID)
 	return lexValue
@@ -236,7 +281,7 @@ func lexSymbol(l *lexer) stateFn {
 }
 
 func lexBinary(l *lexer) stateFn {
-	i := strings.IndexRune(l.input[l.pos:], '_')
+	i := bytes.IndexByte(l.input[l.pos:], '_')
 	if i < 0 {
 		return l.errorf("unending binary")
 	}
@@ -1,25 +1,129 @@
 package gorient
 
 import (
+	"bytes"
+	"encoding/base64"
 	"fmt"
+	"runtime"
 	"strconv"
+	"time"
 )
 
+// parse parses the document in s, panicking with a *SyntaxError if it is
+// malformed.
 func parse(s string) *Document {
-	_, out := lex(s)
+	return parseBytes([]byte(s))
+}
+
+func parseBytes(b []byte) *Document {
+	return parseDoc(&par{lex: lex(b)}, nil)
+}
+
+// decode parses the document in b into d, or a new Document if d is nil.
+// Syntax errors are returned, as a *SyntaxError, rather than panicked.
+// Field and class names are taken from names, if it isn't nil, and
+// times are in loc (UTC if nil).
+func decode(b []byte, d *Document, names nameCache, loc *time.Location) (doc *Document, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			if _, ok := e.(runtime.Error); ok {
+				panic(e)
+			}
+			err = e.(error)
+		}
+	}()
+	return parseDoc(&par{lex: lex(b), names: names, loc: loc}, d), nil
+}
+
+// nameCache interns field and class names, so that decoding many
+// documents of the same shape doesn't allocate a string per name.
+type nameCache map[string]string
+
+// maxCachedNames bounds a nameCache, in case names are open-ended.
+const maxCachedNames = 1024
+
+// A SyntaxError describes malformed record content.
+type SyntaxError struct {
+	Offset  int    // byte offset in the input where the error was found
+	Token   string // the offending token, if any
+	Msg     string // description of the error
+	Context string // the input surrounding Offset
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("gorient: syntax error at offset %d: %s (near %q)",
+		e.Offset, e.Msg, e.Context)
+}
+
+// syntaxContext is the number of bytes of input on either side of an
+// error included in a SyntaxError.
+const syntaxContext = 20
 
-	p := &par{items: out}
-	return parseDoc(p)
+func newSyntaxError(input []byte, off int, tok, msg []byte) *SyntaxError {
+	lo, hi := off-syntaxContext, off+syntaxContext
+	if lo < 0 {
+		lo = 0
+	}
+	if hi > len(input) {
+		hi = len(input)
+	}
+	return &SyntaxError{off, string(tok), string(msg), string(input[lo:hi])}
 }
 
 type par struct {
-	items chan item
+	lex *lexer
 	peekCount int
 	buf [2]item
+	last item // the item most recently returned by next
+	names nameCache
+	loc *time.Location
+}
+
+// unquote returns the contents of the quoted string b.
+func unquote(b []byte) (string, bool) {
+	if len(b) >= 2 && bytes.IndexByte(b, '\\') < 0 {
+		return string(b[1:len(b)-1]), true
+	}
+	s, err := strconv.Unquote(string(b))
+	return s, err == nil
+}
+
+// unquoteName is unquote for map keys, which are interned like names.
+func (p *par) unquoteName(b []byte) (string, bool) {
+	if len(b) >= 2 && bytes.IndexByte(b, '\\') < 0 {
+		return p.name(b[1:len(b)-1]), true
+	}
+	return unquote(b)
+}
+
+// name returns the name in b as a string.
+func (p *par) name(b []byte) string {
+	return p.names.intern(b)
 }
 
+// intern returns b as a string, shared with earlier calls if possible.
+func (c nameCache) intern(b []byte) string {
+	if c == nil {
+		return string(b)
+	}
+	if s, ok := c[string(b)]; ok {
+		return s
+	}
+	s := string(b)
+	if len(c) < maxCachedNames {
+		c[s] = s
+	}
+	return s
+}
+
+// errorf reports an error at the last item read.
 func (p *par) errorf(format string, args ...interface{}) {
-	panic(fmt.Errorf(format, args...))
+	panic(newSyntaxError(p.lex.input, p.last.pos, p.last.val, []byte(fmt.Sprintf(format, args...))))
+}
+
+// lexError reports the error item from the lexer.
+func (p *par) lexError(i item) {
+	panic(newSyntaxError(p.lex.input, i.pos, p.lex.input[i.pos:p.lex.pos], i.val))
 }
 
 func (p *par) peek() item {
@@ -27,7 +131,10 @@ func (p *par) peek() item {
 		return p.buf[p.peekCount-1]
 	}
 	p.peekCount = 1
-	p.buf[0] = <- p.items
+	p.buf[0] = p.lex.nextItem()
+	if p.buf[0].typ == itemError {
+		p.lexError(p.buf[0])
+	}
 	return p.buf[0]
 }
 
@@ -39,9 +146,13 @@ func (p *par) next() item {
 	if p.peekCount > 0 {
 		p.peekCount--
 	} else {
-		p.buf[0] = <- p.items
+		p.buf[0] = p.lex.nextItem()
+		if p.buf[0].typ == itemError {
+			p.lexError(p.buf[0])
+		}
 	}
-	return p.buf[p.peekCount]
+	p.last = p.buf[p.peekCount]
+	return p.last
 }
 
 func (p *par) expect(t itemType) item {
@@ -51,20 +162,29 @@ func (p *par) expect(t itemType) item {
 	}
 	return i
 }
-func parseDoc(p *par) *Document {
+// parseDoc parses the fields of a document into out, or a new Document
+// if out is nil.
+func parseDoc(p *par, out *Document) *Document {
 	// StartDoc has been seen
-	out := &Document{Fields: make(map[string]interface{}, 8)}
+	if out == nil {
+		out = &Document{
+			Fields: make(map[string]interface{}, 8),
+			order: make([]string, 0, 8),
+		}
+	} else {
+		out.Reset()
+	}
 
 	f := p.expect(itemSymbol)
 	div := p.next()
 	if div.typ == itemAt {
-		out.Class = f.val
+		out.Class = p.name(f.val)
 		f = p.expect(itemSymbol)
 		div = p.next()
 	}
 
 	for {
-		out.Fields[f.val] = parseValue(p)
+		out.Set(p.name(f.val), parseValue(p))
 		n := p.next()
 		if n.typ == itemEndDoc {
 			return out
@@ -87,70 +207,93 @@ func parseValue(p *par) interface{} {
 	case itemStartMap:
 		return parseMap(p)
 	case itemStartDoc:
-		return parseDoc(p)
-	case itemStartList, itemStartSet:
-		return parseList(p)
+		return parseDoc(p, nil)
+	case itemStartList:
+		return parseList(p, itemEndList)
+	case itemStartSet:
+		return Set(parseList(p, itemEndSet))
 	case itemString:
-		s, err := strconv.Unquote(n.val)
-		if err != nil { p.errorf("failed to unquote string: %s", n.val) }
+		s, ok := unquote(n.val)
+		if !ok { p.errorf("failed to unquote string: %s", n.val) }
 		return s
 	case itemRID:
-		return n.val
+		v, err := ParseRid(string(n.val))
+		if err != nil { p.errorf("failed to parse rid: %s", n.val) }
+		return v
 	case itemBinary:
-		return n.val
+		// Accept both padded and unpadded base64.
+		src := bytes.TrimRight(n.val, "=")
+		v := make([]byte, base64.RawStdEncoding.DecodedLen(len(src)))
+		_, err := base64.RawStdEncoding.Decode(v, src)
+		if err != nil { p.errorf("failed to decode binary: %s: %v", n.val, err) }
+		return v
 	case itemSymbol:
-		if n.val == "null" {
+		if string(n.val) == "null" {
 			return nil
 		}
-		v, err := strconv.ParseBool(n.val)
+		v, err := strconv.ParseBool(string(n.val))
 		if err != nil { p.errorf("failed to parse bool: %s", n.val) }
 		return v
 	case itemByte:
-		v, err := strconv.ParseInt(n.val, 10, 8)
+		v, err := strconv.ParseInt(string(n.val), 10, 8)
 		if err != nil { p.errorf("failed to parse byte: %s", n.val) }
 		return byte(v)
 	case itemShort:
-		v, err := strconv.ParseInt(n.val, 10, 16)
+		v, err := strconv.ParseInt(string(n.val), 10, 16)
 		if err != nil { p.errorf("failed to parse short: %s", n.val) }
 		return int16(v)
 	case itemInt:
-		v, err := strconv.ParseInt(n.val, 10, 32)
+		v, err := strconv.ParseInt(string(n.val), 10, 32)
 		if err != nil { p.errorf("failed to parse int: %s", n.val) }
 		return int32(v)
 	case itemLong:
-		v, err := strconv.ParseInt(n.val, 10, 64)
+		v, err := strconv.ParseInt(string(n.val), 10, 64)
 		if err != nil { p.errorf("failed to parse long: %s", n.val) }
 		return v
-	case itemDate, itemTime:
-		v, err := strconv.ParseUint(n.val, 10, 64)
+	case itemDate:
+		v, err := strconv.ParseInt(string(n.val), 10, 64)
+		if err != nil { p.errorf("failed to parse date: %s", n.val) }
+		return Date{dateOf(msTime(v, p.loc), p.loc)}
+	case itemTime:
+		v, err := strconv.ParseInt(string(n.val), 10, 64)
 		if err != nil { p.errorf("failed to parse time: %s", n.val) }
-		return v
+		return msTime(v, p.loc)
 	case itemFloat:
-		v, err := strconv.ParseFloat(n.val, 32)
+		v, err := strconv.ParseFloat(string(n.val), 32)
 		if err != nil { p.errorf("failed to parse float: %s", n.val) }
 		return float32(v)
-	case itemDouble, itemBigDecimal:
-		v, err := strconv.ParseFloat(n.val, 64)
+	case itemDouble:
+		v, err := strconv.ParseFloat(string(n.val), 64)
 		if err != nil { p.errorf("failed to parse double: %s", n.val) }
 		return v
+	case itemBigDecimal:
+		v, err := ParseDecimal(string(n.val))
+		if err != nil { p.errorf("failed to parse decimal: %s", n.val) }
+		return v
 	}
 	p.errorf("unrecognized: %s (%s)", n.val, n.typ)
 	return nil
 }
 
-func parseList(p *par) interface{} {
+// parseList parses the elements of a list or set, up to the closing end
+// item.
+func parseList(p *par, end itemType) []interface{} {
 	out := make([]interface{}, 0)
 	for {
 		n := p.next()
-		if n.typ == itemEndList || n.typ == itemEndSet {
+		switch n.typ {
+		case end:
 			return out
-		}
-		if n.typ != itemComma {
+		case itemEndList, itemEndSet, itemEndMap:
+			p.errorf("expected %s, got %s", end, n.typ)
+		case itemEndDoc:
+			p.errorf("expected %s, got end of input", end)
+		case itemComma:
+		default:
 			p.backup()
 		}
 		out = append(out, parseValue(p))
 	}
-	return out
 }
 
 func parseMap(p *par) interface{} {
@@ -163,11 +306,16 @@ func parseMap(p *par) interface{} {
 		if f.typ == itemComma {
 			f = p.next()
 		}
+		if f.typ == itemEndDoc {
+			p.errorf("expected %s, got end of input", itemEndMap)
+		}
 		if f.typ != itemString {
 			p.errorf("expected field name (string), got %s", f.typ)
 		}
+		k, ok := p.unquoteName(f.val)
+		if !ok { p.errorf("failed to unquote map key: %s", f.val) }
 		p.expect(itemColon)
-		out[f.val] = parseValue(p)
+		out[k] = parseValue(p)
 	}
 	return nil
 }
@@ -2,23 +2,33 @@ package gorient
 
 import (
 	"fmt"
+	"math/big"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 var testrec string = "ORole@name:\"reader\",inheritedRole:,embedded:(Blah@name:\"Bob\",age:32),rules:{\"byte\":12b,\"short\":245s,\"long\":58585l,\"float\":4.4f,\"double\":4.484844d,\"big\":0.58595884848484c,\"time\":1296279468000t,\"binary\":_AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGx_,\"bool\":true,\"null\":null,\"date\":1306281600000a,\"database.command\":2,\"database.hook.record\":2}"
 
 
+// parseDocument parses s, returning any syntax error.
+func parseDocument(s string) (*Document, error) {
+	return decode([]byte(s), nil, nil, nil)
+}
+
 func BenchmarkLex(b *testing.B) {
+	in := []byte(testrec)
 	for i := 0; i < b.N; i++ {
-		_,items := lex(testrec)
-		for _ = range items {
+		for l := lex(in); l.state != nil; {
+			l.nextItem()
 		}
 	}
 }
 func BenchmarkParse(b *testing.B) {
+	in := []byte(testrec)
 	for i := 0; i < b.N; i++ {
-		parse(testrec)
+		parseBytes(in)
 	}
 }
 
@@ -29,6 +39,7 @@ func TestTrailingSpace(t *testing.T) {
 			"city": "TORINO",
 			"gender": "f",
 		},
+		order: []string{"name", "city", "gender"},
 	}
 	if !reflect.DeepEqual(parse(s), d) {
 		t.Fail()
@@ -41,6 +52,7 @@ func TestTrailingNull(t *testing.T) {
 			"f1":"a",
 			"f2":nil,
 		},
+		order: []string{"f1", "f2"},
 	}
 	if !reflect.DeepEqual(parse(s), d) {
 		fmt.Println(parse(s))
@@ -59,20 +71,24 @@ func TestParse(t *testing.T) {
 		Fields: map[string]interface{} {
 			"nick": "B \"POTUS\" Obama",
 			"follows": []interface{} {},
-			"followers": []interface{} {"#10:5", "#10:6"},
+			"followers": []interface{} {Rid{10, 5}, Rid{10, 6}},
 			"name": "Barack",
 			"age": int32(51),
-			"location": "#3:2",
+			"location": Rid{3, 2},
 			"salary": float32(120.3),
 			"dog": &Document{
 				"Animal",
 				map[string]interface{} {"name":"Fido"},
+				[]string{"name"},
 			},
 			"cat": &Document{
 				Fields: map[string]interface{} {"name":"Pip","age":int16(7)},
+				order: []string{"name", "age"},
 			},
-			"x": []interface{} {int32(1), int32(2)},
+			"x": Set{int32(1), int32(2)},
 		},
+		order: []string{"nick", "follows", "followers", "name", "age",
+			"location", "salary", "dog", "cat", "x"},
 	}
 
 	if !reflect.DeepEqual(d, d1) {
@@ -86,3 +102,186 @@ func TestParse(t *testing.T) {
 		}
 	}
 }
+
+func TestBinary(t *testing.T) {
+	d := parse(`a:_AAECAwQF_,b:_aGk=_,c:_aGk_,d:__`)
+	want := map[string]interface{}{
+		"a": []byte{0, 1, 2, 3, 4, 5},
+		"b": []byte("hi"),
+		"c": []byte("hi"),
+		"d": []byte{},
+	}
+	if !reflect.DeepEqual(d.Fields, want) {
+		t.Errorf("got %v", d.Fields)
+	}
+
+	out, err := Marshal(d)
+	if err != nil || !reflect.DeepEqual(parse(string(out)), d) {
+		t.Errorf("round trip: got %s, %v", out, err)
+	}
+
+	var v struct{ A, B []byte }
+	if err := Unmarshal([]byte(`A:_AAECAwQF_,B:`), &v); err != nil || len(v.A) != 6 || v.B != nil {
+		t.Errorf("Unmarshal: got %v, %v", v, err)
+	}
+
+	b, ok := parse(testrec).Fields["rules"].(map[string]interface{})["binary"].([]byte)
+	if !ok || len(b) != 28 || b[0] != 0 || b[27] != 27 {
+		t.Errorf("testrec binary: got %v", b)
+	}
+
+	_, err = parseDocument(`a:_not*base64_`)
+	if err == nil || !strings.Contains(err.Error(), "binary") {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestDate(t *testing.T) {
+	d := parse(testrec).Fields["rules"].(map[string]interface{})
+	if tm := d["time"]; tm != time.Date(2011, 1, 29, 5, 37, 48, 0, time.UTC) {
+		t.Errorf("time: got %v", tm)
+	}
+	if tm := d["date"]; tm != (Date{time.Date(2011, 5, 25, 0, 0, 0, 0, time.UTC)}) {
+		t.Errorf("date: got %v", tm)
+	}
+
+	// Dates are normalized to midnight in the database's zone, which is
+	// set per connection.
+	loc := time.FixedZone("UTC+2", 2*60*60)
+	x := &Xx{Location: loc}
+	d = x.document([]byte(`d:1306274400000a,e:1306281600000a,t:1306281600000t`)).Fields
+	if tm := d["d"].(Date); !tm.Equal(time.Date(2011, 5, 25, 0, 0, 0, 0, loc)) || tm.Location() != loc {
+		t.Errorf("date: got %v", tm)
+	}
+	if tm := d["e"].(Date); !tm.Equal(time.Date(2011, 5, 25, 0, 0, 0, 0, loc)) {
+		t.Errorf("date: got %v", tm)
+	}
+
+	// A date can be stored in a time.Time field.
+	var v struct {
+		On time.Time `orient:"on,date"`
+		D  Date      `orient:"d"`
+	}
+	if err := Unmarshal([]byte(`on:1306281600000a,d:1306281600000a`), &v); err != nil ||
+		!v.On.Equal(time.Date(2011, 5, 25, 0, 0, 0, 0, time.UTC)) || !v.D.Equal(v.On) {
+		t.Errorf("Unmarshal: got %v, %v", v, err)
+	}
+	if tm := d["t"].(time.Time); !tm.Equal(time.Date(2011, 5, 25, 2, 0, 0, 0, loc)) {
+		t.Errorf("datetime: got %v", tm)
+	}
+}
+
+func TestNumbers(t *testing.T) {
+	d := parse(`a:-5,b:-3.2d,c:1.0E-7d,d:-1.5e+3f,e:+7l,f:-12b,g:-300s,h:1E5d,i:-0.001c,j:-1000t,k:[-1,-2]`)
+	want := map[string]interface{}{
+		"a": int32(-5),
+		"b": -3.2,
+		"c": 1.0e-7,
+		"d": float32(-1500),
+		"e": int64(7),
+		"f": byte(0xf4),
+		"g": int16(-300),
+		"h": 1e5,
+		"i": Decimal{big.NewInt(-1), 3},
+		"j": time.Unix(-1, 0).In(time.UTC),
+		"k": []interface{}{int32(-1), int32(-2)},
+	}
+	if !reflect.DeepEqual(d.Fields, want) {
+		t.Errorf("got  %v\nwant %v", d.Fields, want)
+	}
+
+	for _, s := range []string{`a:-`, `a:1.0E`, `a:1.0E-d`, `a:-x`, `a:--1`} {
+		if d, err := parseDocument(s); err == nil {
+			t.Errorf("parse(%q) = %v, want error", s, d)
+		}
+	}
+}
+
+func TestListsAndSets(t *testing.T) {
+	d := parse(`l:[1,<2,3>],s:<[1],<>>,e:[]`)
+	want := map[string]interface{}{
+		"l": []interface{}{int32(1), Set{int32(2), int32(3)}},
+		"s": Set{[]interface{}{int32(1)}, Set{}},
+		"e": []interface{}{},
+	}
+	if !reflect.DeepEqual(d.Fields, want) {
+		t.Errorf("got %v", d.Fields)
+	}
+
+	for _, s := range []string{`a:[1,2>`, `a:<1,2]`, `a:[1,2}`, `a:<(b:1]>`, `a:[<1]>`} {
+		if d, err := parseDocument(s); err == nil {
+			t.Errorf("parse(%q) = %v, want error", s, d)
+		}
+	}
+}
+
+// The lexer runs only when the parser asks for an item, so it stops at
+// its first error, and asking again doesn't lex any further.
+func TestLexStopsAtError(t *testing.T) {
+	l := lex([]byte(`a:$,` + testrec))
+	i := l.nextItem()
+	for n := 0; i.typ != itemError; n++ {
+		if n > 10 {
+			t.Fatal("no error item")
+		}
+		i = l.nextItem()
+	}
+	if string(i.val) != "unrecognized character '$'" || i.pos != 2 {
+		t.Errorf("got %s at %d", i.val, i.pos)
+	}
+	pos := l.pos
+	if i = l.nextItem(); i.typ != itemError || l.pos != pos {
+		t.Errorf("after the error: got %v, lexed to %d", i, l.pos)
+	}
+	if _, err := parseDocument(`a:$,` + testrec); err == nil || err.(*SyntaxError).Offset != 2 {
+		t.Errorf("parseDocument: got %v", err)
+	}
+}
+
+func TestSyntaxError(t *testing.T) {
+	tests := []struct {
+		in     string
+		offset int
+		token  string
+		msg    string
+	}{
+		{`name:"Bob",age:300b`, 15, "300", "failed to parse byte"},
+		{`name:"Bob"age:3`, 10, "age", "expected Comma"},
+		{`name:"Bob",tags:[1,2>`, 20, ">", "expected EndList, got EndSet"},
+		{`name:"Bob",x:$`, 13, "$", "unrecognized character '$'"},
+		{`name:"Bob`, 5, `"Bob`, "unterminated quoted string"},
+		{`data:_AAEC`, 6, "", "unending binary"},
+		{`n:1.5E+x`, 2, "1.5E+", "malformed number"},
+		{`a:[1,2`, 6, "", "expected EndList, got end of input"},
+		{`a:<1`, 4, "", "expected EndSet, got end of input"},
+		{`a:{"x":1`, 8, "", "expected EndMap, got end of input"},
+	}
+	for _, tt := range tests {
+		_, err := parseDocument(tt.in)
+		e, ok := err.(*SyntaxError)
+		if !ok {
+			t.Errorf("%s: got %v, want SyntaxError", tt.in, err)
+			continue
+		}
+		if e.Offset != tt.offset || e.Token != tt.token || !strings.HasPrefix(e.Msg, tt.msg) {
+			t.Errorf("%s: got offset %d, token %q, msg %q", tt.in, e.Offset, e.Token, e.Msg)
+		}
+	}
+
+	long := strings.Repeat("a:1,", 20) + "b:?," + strings.Repeat("c:1,", 20)
+	_, err := parseDocument(long)
+	e, ok := err.(*SyntaxError)
+	if !ok || e.Context != `1,a:1,a:1,a:1,a:1,b:?,c:1,c:1,c:1,c:1,c:` {
+		t.Errorf("got %#v", err)
+	}
+	if !strings.Contains(err.Error(), "offset 82") {
+		t.Errorf("Error() = %s", err)
+	}
+
+	var v struct{ Name string }
+	if err := Unmarshal([]byte(`Name:"x",?`), &v); err == nil {
+		t.Error("Unmarshal: expected error")
+	} else if _, ok := err.(*SyntaxError); !ok {
+		t.Errorf("Unmarshal: got %T", err)
+	}
+}
@@ -0,0 +1,335 @@
+package gorient
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// A Pool is a set of connections to one database, shared by
+// goroutines that each need a connection for a while.  Get takes a
+// connection and Put returns it.
+//
+// Idle connections are validated with a DB_SIZE request before Get
+// hands them out; connections that fail, or that were left broken by a
+// request, are closed and replaced.
+//
+// The requests on Xx are not exported yet, so only code in this package
+// can use the connections a Pool hands out.  Callers elsewhere can
+// configure a Pool and watch its Stats, but not query through it.
+type Pool struct {
+	// Dial opens a new connection.
+	Dial func() (*Xx, error)
+
+	// MinIdle is the number of idle connections the pool tries to keep
+	// ready.  MaxIdle caps the number kept when they are returned; zero
+	// means 2.  MaxOpen, if positive, limits the number of connections,
+	// and Get waits for one to be returned when it is reached.
+	MinIdle int
+	MaxIdle int
+	MaxOpen int
+
+	// IdleTimeout, if positive, closes connections (beyond MinIdle)
+	// that have been idle longer than this.
+	IdleTimeout time.Duration
+
+	// ValidateTimeout limits the validation of an idle connection; a
+	// connection that takes longer fails it.  Zero means 5 seconds.
+	ValidateTimeout time.Duration
+
+	mu      sync.Mutex
+	idle    []idleConn // most recently used last
+	open    int        // connections open or being dialed
+	waiters []chan *Xx // nil is sent when a slot frees up
+	filling bool
+	closed  bool
+	stats   PoolStats
+}
+
+type idleConn struct {
+	x     *Xx
+	since time.Time
+}
+
+// PoolStats reports a pool's connections and how it has been used.
+type PoolStats struct {
+	Open  int // connections open, idle or in use
+	Idle  int
+	InUse int
+
+	Gets         int64 // successful Gets
+	Dials        int64 // connections opened
+	DialErrors   int64
+	WaitCount    int64         // Gets that waited for a connection
+	WaitDuration time.Duration // total time spent waiting
+
+	Broken     int64 // closed because a request broke them
+	Invalid    int64 // closed because validation failed
+	IdleClosed int64 // closed by MaxIdle or IdleTimeout
+}
+
+// ErrPoolClosed is returned by Get on a closed pool.
+var ErrPoolClosed = errors.New("gorient: pool closed")
+
+const (
+	defaultMaxIdle         = 2
+	defaultValidateTimeout = 5 * time.Second
+)
+
+// NewPool returns a pool of connections to database db at host.  To
+// dial with TLS or a custom Dialer, replace its Dial.
+func NewPool(host, db, user, pass string) *Pool {
+	return &Pool{
+		Dial: func() (*Xx, error) {
+			x := &Xx{}
+			if err := x.open(host, db, user, pass); err != nil {
+				return nil, err
+			}
+			return x, nil
+		},
+	}
+}
+
+func (p *Pool) maxIdle() int {
+	n := p.MaxIdle
+	if n <= 0 {
+		n = defaultMaxIdle
+	}
+	if n < p.MinIdle {
+		n = p.MinIdle
+	}
+	return n
+}
+
+// Get returns a validated idle connection or dials a new one.  If
+// MaxOpen connections are open it waits for one to be returned.
+func (p *Pool) Get() (*Xx, error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ErrPoolClosed
+		}
+		p.expire()
+		if n := len(p.idle); n > 0 {
+			x := p.idle[n-1].x
+			p.idle = p.idle[:n-1]
+			p.mu.Unlock()
+			if !p.validate(x) {
+				continue
+			}
+			p.got()
+			return x, nil
+		}
+		if p.MaxOpen > 0 && p.open >= p.MaxOpen {
+			ch := make(chan *Xx, 1)
+			p.waiters = append(p.waiters, ch)
+			p.stats.WaitCount++
+			p.mu.Unlock()
+
+			start := time.Now()
+			x, ok := <-ch
+			p.mu.Lock()
+			p.stats.WaitDuration += time.Since(start)
+			p.mu.Unlock()
+			if !ok {
+				return nil, ErrPoolClosed
+			}
+			if x == nil {
+				// A slot was freed; dial with it.
+				return p.dial()
+			}
+			p.got()
+			return x, nil
+		}
+		p.open++
+		p.mu.Unlock()
+		return p.dial()
+	}
+}
+
+// dial opens a connection in a slot already counted in p.open.
+func (p *Pool) dial() (*Xx, error) {
+	x, err := p.Dial()
+	p.mu.Lock()
+	if err != nil {
+		p.stats.DialErrors++
+		p.mu.Unlock()
+		p.release(true)
+		return nil, err
+	}
+	p.stats.Dials++
+	p.stats.Gets++
+	p.mu.Unlock()
+	p.fill()
+	return x, nil
+}
+
+func (p *Pool) got() {
+	p.mu.Lock()
+	p.stats.Gets++
+	p.mu.Unlock()
+	p.fill()
+}
+
+// validate checks an idle connection with a DB_SIZE request, closing
+// it and freeing its slot if it fails or takes too long.
+func (p *Pool) validate(x *Xx) bool {
+	timeout := p.ValidateTimeout
+	if timeout <= 0 {
+		timeout = defaultValidateTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if _, err := x.sizeContext(ctx); err != nil {
+		x.close()
+		p.mu.Lock()
+		p.stats.Invalid++
+		p.mu.Unlock()
+		p.release(true)
+		return false
+	}
+	return true
+}
+
+// Put returns a connection taken by Get.  A broken connection is
+// closed and its slot freed.
+func (p *Pool) Put(x *Xx) {
+	if x.broken() {
+		x.close()
+		p.mu.Lock()
+		p.stats.Broken++
+		p.mu.Unlock()
+		p.release(true)
+		return
+	}
+	p.mu.Lock()
+	if p.closed {
+		p.open--
+		p.mu.Unlock()
+		x.close()
+		return
+	}
+	if len(p.waiters) > 0 {
+		ch := p.waiters[0]
+		p.waiters = p.waiters[1:]
+		p.mu.Unlock()
+		ch <- x
+		return
+	}
+	if len(p.idle) >= p.maxIdle() {
+		p.stats.IdleClosed++
+		p.open--
+		p.mu.Unlock()
+		x.close()
+		return
+	}
+	p.idle = append(p.idle, idleConn{x, time.Now()})
+	p.mu.Unlock()
+}
+
+// release frees the slot of a connection that was closed or never
+// opened, handing it to a waiter if there is one, and optionally
+// refills the idle connections.
+func (p *Pool) release(refill bool) {
+	p.mu.Lock()
+	if len(p.waiters) > 0 {
+		ch := p.waiters[0]
+		p.waiters = p.waiters[1:]
+		p.mu.Unlock()
+		ch <- nil
+		return
+	}
+	p.open--
+	p.mu.Unlock()
+	if refill {
+		p.fill()
+	}
+}
+
+// expire closes connections idle longer than IdleTimeout, keeping
+// MinIdle.  p.mu must be held.
+func (p *Pool) expire() {
+	if p.IdleTimeout <= 0 {
+		return
+	}
+	cutoff := time.Now().Add(-p.IdleTimeout)
+	n := 0 // the idle list is oldest first
+	for n < len(p.idle)-p.MinIdle && p.idle[n].since.Before(cutoff) {
+		go p.idle[n].x.close()
+		n++
+	}
+	if n > 0 {
+		p.idle = append(p.idle[:0], p.idle[n:]...)
+		p.open -= n
+		p.stats.IdleClosed += int64(n)
+	}
+}
+
+// fill dials connections in the background until MinIdle are idle.
+func (p *Pool) fill() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.filling || p.closed || len(p.idle) >= p.MinIdle {
+		return
+	}
+	p.filling = true
+	go func() {
+		for {
+			p.mu.Lock()
+			if p.closed || len(p.idle) >= p.MinIdle ||
+				(p.MaxOpen > 0 && p.open >= p.MaxOpen) {
+				p.filling = false
+				p.mu.Unlock()
+				return
+			}
+			p.open++
+			p.mu.Unlock()
+
+			x, err := p.Dial()
+			p.mu.Lock()
+			if err != nil {
+				// Try again after the next Get or Put.
+				p.stats.DialErrors++
+				p.filling = false
+				p.mu.Unlock()
+				p.release(false)
+				return
+			}
+			p.stats.Dials++
+			p.mu.Unlock()
+			p.Put(x)
+		}
+	}()
+}
+
+// Stats returns the pool's current statistics.
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.stats
+	s.Open = p.open
+	s.Idle = len(p.idle)
+	s.InUse = p.open - len(p.idle)
+	return s
+}
+
+// Close closes the idle connections and fails any waiting Gets.
+// Connections in use are closed when they are returned.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.open -= len(idle)
+	p.closed = true
+	for _, ch := range p.waiters {
+		close(ch)
+	}
+	p.waiters = nil
+	p.mu.Unlock()
+	for _, c := range idle {
+		c.x.close()
+	}
+	return nil
+}
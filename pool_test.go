@@ -0,0 +1,172 @@
+package gorient
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPool(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.close()
+	p := NewPool(s.addr(), "test", "admin", "admin")
+	defer p.Close()
+
+	x, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Put(x)
+	if y, err := p.Get(); err != nil || y != x {
+		t.Errorf("Get: got %p, %v; want the idle connection %p", y, err, x)
+	}
+
+	// A connection broken while in use is closed on Put.
+	x.conn.Close()
+	if _, err := x.size(); err == nil {
+		t.Fatal("size on closed connection: expected error")
+	}
+	p.Put(x)
+
+	// One broken while idle fails validation.
+	y, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Put(y)
+	y.conn.Close()
+	z, err := p.Get()
+	if err != nil || z == y {
+		t.Fatalf("Get after idle connection closed: got %p, %v", z, err)
+	}
+	p.Put(z)
+
+	st := p.Stats()
+	if st.Dials != 3 || st.Gets != 4 || st.Broken != 1 || st.Invalid != 1 ||
+		st.Open != 1 || st.Idle != 1 || st.InUse != 0 {
+		t.Errorf("stats: %+v", st)
+	}
+
+	p.Close()
+	if _, err := p.Get(); err != ErrPoolClosed {
+		t.Errorf("Get on closed pool: got %v", err)
+	}
+}
+
+func TestPoolMaxOpen(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.close()
+	p := NewPool(s.addr(), "test", "admin", "admin")
+	p.MaxOpen = 2
+	defer p.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			x, err := p.Get()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer p.Put(x)
+			if _, err := x.size(); err != nil {
+				t.Error(err)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}()
+	}
+	wg.Wait()
+
+	st := p.Stats()
+	if st.Dials > 2 || st.Open > 2 || st.Gets != 8 || st.WaitCount == 0 || st.WaitDuration == 0 {
+		t.Errorf("stats: %+v", st)
+	}
+
+	// A waiting Get fails when the pool is closed.
+	x, _ := p.Get()
+	y, _ := p.Get()
+	done := make(chan error)
+	go func() {
+		_, err := p.Get()
+		done <- err
+	}()
+	for p.Stats().WaitCount == st.WaitCount {
+		time.Sleep(time.Millisecond)
+	}
+	p.Close()
+	if err := <-done; err != ErrPoolClosed {
+		t.Errorf("waiting Get: got %v", err)
+	}
+	p.Put(x)
+	p.Put(y)
+	if st := p.Stats(); st.Open != 0 {
+		t.Errorf("open after close: %d", st.Open)
+	}
+}
+
+func TestPoolIdle(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.close()
+	p := NewPool(s.addr(), "test", "admin", "admin")
+	p.MinIdle = 2
+	p.MaxIdle = 3
+	p.IdleTimeout = 10 * time.Millisecond
+	defer p.Close()
+
+	xs := make([]*Xx, 5)
+	for i := range xs {
+		var err error
+		if xs[i], err = p.Get(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, x := range xs {
+		p.Put(x)
+	}
+	if st := p.Stats(); st.Idle != 3 || st.IdleClosed < 2 {
+		t.Errorf("after Put: %+v", st)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	x, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The idle timeout leaves MinIdle, and taking one starts a refill.
+	deadline := time.Now().Add(time.Second)
+	for p.Stats().Idle < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if st := p.Stats(); st.Idle != 2 || st.Open != 3 {
+		t.Errorf("after idle timeout: %+v", st)
+	}
+	p.Put(x)
+}
+
+func TestPoolValidateTimeout(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.close()
+	p := NewPool(s.addr(), "test", "admin", "admin")
+	p.ValidateTimeout = 20 * time.Millisecond
+	defer p.Close()
+
+	x, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Put(x)
+	// The idle connection's validation hangs, so it is replaced.
+	s.mu.Lock()
+	s.stallSize = true
+	s.mu.Unlock()
+	y, err := p.Get()
+	if err != nil || y == x {
+		t.Fatalf("Get: got %p, %v", y, err)
+	}
+	p.Put(y)
+	if st := p.Stats(); st.Invalid != 1 || st.Dials != 2 || st.Open != 1 {
+		t.Errorf("stats: %+v", st)
+	}
+}
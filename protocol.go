@@ -0,0 +1,119 @@
+package gorient
+
+import (
+	"fmt"
+)
+
+// A protocol describes how one version of the binary protocol lays out
+// the requests and responses this client uses.  The server sends its
+// version on connect, and the client speaks the newest version it knows
+// that is no newer than the server's.
+type protocol struct {
+	version int16
+
+	// DB_OPEN: the request names the record serializer (see
+	// Serializer), and asks for a token session.  In the response each
+	// cluster entry carries its type and data segment id, a token
+	// follows the session id, and the server's release comes last.
+	serializer   bool
+	tokenSession bool
+	clusterType  bool
+	release      bool
+
+	// RECORD_LOAD takes a load-tombstones flag after ignore-cache, and
+	// the record comes back as type, version and content rather than
+	// content, version and type.
+	tombstones    bool
+	loadTypeFirst bool
+
+	// RECORD_CREATE starts with a data segment id, and its response
+	// with the cluster id.
+	dataSegment     bool
+	createClusterId bool
+
+	// RECORD_UPDATE takes an update-content flag after the id.
+	updateContent bool
+
+	// RECORD_CREATE and RECORD_UPDATE responses end with the changes
+	// made to link bag trees.
+	collectionChanges bool
+
+	// A synchronous COMMAND response ends with records prefetched by
+	// the fetch plan, each preceded by a 2 byte, then a 0 byte.
+	commandPrefetch bool
+}
+
+// protocols lists the supported versions, oldest first.  Each row's
+// layouts follow the protocol document for that version; versions
+// between rows, such as 16 to 21, are not modeled, and a server speaking
+// one is sent the older row's version, which OrientDB servers accept
+// from older clients.
+var protocols = []*protocol{
+	{version: 13, clusterType: true, tombstones: true, dataSegment: true},
+	{version: 14, clusterType: true, tombstones: true, dataSegment: true, release: true},
+	// 15 changes nothing used here.
+	{version: 15, clusterType: true, tombstones: true, dataSegment: true, release: true},
+	{
+		version: 22, clusterType: true, tombstones: true, dataSegment: true, release: true,
+		serializer: true, collectionChanges: true, commandPrefetch: true,
+	},
+	{
+		version: 24, tombstones: true, release: true,
+		serializer: true, collectionChanges: true, commandPrefetch: true,
+		updateContent: true, createClusterId: true,
+	},
+	{
+		version: 26, tombstones: true, release: true,
+		serializer: true, collectionChanges: true, commandPrefetch: true,
+		updateContent: true, createClusterId: true,
+		tokenSession: true,
+	},
+	{
+		version: 28, tombstones: true, release: true,
+		serializer: true, collectionChanges: true, commandPrefetch: true,
+		updateContent: true, createClusterId: true,
+		tokenSession: true, loadTypeFirst: true,
+	},
+}
+
+// A Serializer is a format for record content, chosen when a database
+// is opened.
+type Serializer int
+
+const (
+	// SerializerCSV is the record string format (see Marshal).
+	SerializerCSV Serializer = iota
+
+	// SerializerBinary is the binary record format (see
+	// MarshalBinary), which needs protocol 22 or later.
+	SerializerBinary
+)
+
+// name returns the server's name for s.
+func (s Serializer) name() string {
+	if s == SerializerBinary {
+		return "ORecordSerializerBinary"
+	}
+	return "ORecordDocument2csv"
+}
+
+// An UnsupportedProtocolError reports a server too old for any
+// supported protocol version.
+type UnsupportedProtocolError struct {
+	Version int16 // the server's
+}
+
+func (e *UnsupportedProtocolError) Error() string {
+	return fmt.Sprintf("gorient: unsupported protocol version %d (need %d or later)",
+		e.Version, protocols[0].version)
+}
+
+// negotiate returns the protocol to use with a server speaking version.
+func negotiate(version int16) (*protocol, error) {
+	for i := len(protocols) - 1; i >= 0; i-- {
+		if p := protocols[i]; p.version <= version {
+			return p, nil
+		}
+	}
+	return nil, &UnsupportedProtocolError{version}
+}
@@ -0,0 +1,92 @@
+package gorient
+
+import (
+	"fmt"
+	"math"
+)
+
+// Push frames are sent by the server unprompted, and may arrive ahead
+// of the response to a request:
+//
+//	(PUSH_DATA:byte)(Integer.MIN_VALUE:int)(push-type:byte)(content)
+//
+// beginResp reads and queues them.  They are delivered to the handlers
+// once the request is done and the connection released, so a handler
+// may make requests of its own.
+type push struct {
+	typ    byte
+	record Record    // PUSH_RECORD
+	config *Document // PUSH_DISTRIB_CONFIG
+}
+
+const pushSession = math.MinInt32
+
+// onRecordPush sets fn to be called with each record the server pushes
+// (a record changed elsewhere, for a client caching it).
+func (x *Xx) onRecordPush(fn func(Record)) {
+	x.mu.Lock()
+	x.recordPush = fn
+	x.mu.Unlock()
+}
+
+// onConfigPush sets fn to be called with each distributed (cluster)
+// configuration the server pushes.
+func (x *Xx) onConfigPush(fn func(*Document)) {
+	x.mu.Lock()
+	x.configPush = fn
+	x.mu.Unlock()
+}
+
+// readPush reads a push frame after its PUSH_DATA status byte.
+func (x *Xx) readPush() {
+	if sess := x.readInt32(); sess != pushSession {
+		panic(fmt.Errorf("%w: push for session %d", ErrDesync, sess))
+	}
+	p := push{typ: x.readByte()}
+	switch p.typ {
+	case PUSH_RECORD:
+		p.record = x.readRecord()
+	case PUSH_DISTRIB_CONFIG:
+		p.config = x.document(x.readBytes())
+	default:
+		// The frame's length depends on its type.
+		panic(fmt.Errorf("%w: unrecognized push type: %d", ErrDesync, p.typ))
+	}
+	x.pushes = append(x.pushes, p)
+}
+
+// deliverPushes passes queued pushes to the handlers, in the order they
+// arrived.  Pushes without a handler are dropped.  It is called without
+// x.mu held; if another goroutine is already delivering, that goroutine
+// delivers these too.  A handler's panic propagates to the caller, and
+// the rest of its batch is dropped.
+func (x *Xx) deliverPushes() {
+	x.mu.Lock()
+	if x.delivering || len(x.pushes) == 0 {
+		x.mu.Unlock()
+		return
+	}
+	x.delivering = true
+	defer func() {
+		x.delivering = false
+		x.mu.Unlock()
+	}()
+	for len(x.pushes) > 0 {
+		ps := x.pushes
+		x.pushes = nil
+		onRecord, onConfig := x.recordPush, x.configPush
+		func() {
+			x.mu.Unlock()
+			// Relocked even if a handler panics.
+			defer x.mu.Lock()
+			for _, p := range ps {
+				switch {
+				case p.typ == PUSH_RECORD && onRecord != nil:
+					onRecord(p.record)
+				case p.typ == PUSH_DISTRIB_CONFIG && onConfig != nil:
+					onConfig(p.config)
+				}
+			}
+		}()
+	}
+}
@@ -0,0 +1,82 @@
+package gorient
+
+import (
+	"testing"
+)
+
+func TestPush(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.close()
+	x, _ := dialFake(t, s)
+	defer x.close()
+
+	var pushed []Record
+	x.onRecordPush(func(r Record) {
+		// Handlers run with the connection released.
+		if _, err := x.size(); err != nil {
+			t.Error(err)
+		}
+		pushed = append(pushed, r)
+	})
+	var members []interface{}
+	x.onConfigPush(func(d *Document) {
+		members, _ = d.GetList("members")
+	})
+
+	// The fake server pushes each updated record ahead of the response.
+	ver, err := x.updateRecord(Rid{9, 1}, &animal{Class: "Animal", Name: "Rex"}, 1)
+	if ver != 2 || err != nil {
+		t.Fatalf("updateRecord: version %d, %v", ver, err)
+	}
+	if len(pushed) != 1 || pushed[0].Rid != (Rid{9, 1}) || pushed[0].Version != 2 {
+		t.Fatalf("pushed %v", pushed)
+	}
+	if d, ok := pushed[0].Value.(*Document); !ok || d.Fields["name"] != "Rex" {
+		t.Errorf("pushed record %v", pushed[0].Value)
+	}
+
+	rs, err := x.command("push config", "c", 's', -1, "")
+	if err != nil || len(rs.Records) != 1 {
+		t.Fatalf("command: got %v, %v", rs, err)
+	}
+	if len(members) != 2 {
+		t.Errorf("config members: %v", members)
+	}
+
+	// Without a handler, pushes are dropped.
+	x.onRecordPush(nil)
+	if _, err := x.updateRecord(Rid{9, 1}, &animal{Class: "Animal", Name: "Max"}, 2); err != nil {
+		t.Fatal(err)
+	}
+	if len(pushed) != 1 {
+		t.Errorf("pushed %d records", len(pushed))
+	}
+}
+
+func TestPushHandlerPanic(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.close()
+	x, _ := dialFake(t, s)
+	defer x.close()
+
+	x.onRecordPush(func(r Record) { panic("handler") })
+	func() {
+		defer func() {
+			if e := recover(); e != "handler" {
+				t.Errorf("recovered %v", e)
+			}
+		}()
+		x.updateRecord(Rid{9, 1}, &animal{Class: "Animal", Name: "Rex"}, 1)
+		t.Error("handler didn't panic")
+	}()
+
+	// The connection is unlocked and pushes are delivered again.
+	var pushed int
+	x.onRecordPush(func(r Record) { pushed++ })
+	if _, err := x.updateRecord(Rid{9, 1}, &animal{Class: "Animal", Name: "Max"}, 2); err != nil {
+		t.Fatal(err)
+	}
+	if pushed != 1 {
+		t.Errorf("pushed %d records", pushed)
+	}
+}
@@ -0,0 +1,99 @@
+package gorient
+
+import (
+	"bytes"
+	"testing"
+)
+
+func dialReconnect(t *testing.T, s *fakeServer) *Xx {
+	x := &Xx{Reconnect: true}
+	if err := x.open(s.addr(), "test", "admin", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	return x
+}
+
+func TestTokenSession(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.close()
+	x := dialReconnect(t, s)
+	defer x.close()
+
+	if len(x.token) == 0 {
+		t.Fatal("no token after open")
+	}
+	tok := x.token
+	if _, _, err := x.loadRecord(Rid{9, 1}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(x.token, tok) {
+		t.Errorf("token changed to %q without renewal", x.token)
+	}
+	// The fake server renews the token on DB_COUNTRECORDS.
+	if _, err := x.recordCount(); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(x.token, tok) {
+		t.Error("token not renewed")
+	}
+	if _, err := x.size(); err != nil {
+		t.Errorf("request with renewed token: %v", err)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.close()
+	x := dialReconnect(t, s)
+	defer x.close()
+
+	sess, tok := x.sess, x.token
+	s.restart()
+	// Loads are retried on a new connection.
+	if _, _, err := x.loadRecord(Rid{9, 1}, ""); err != nil {
+		t.Fatalf("load after restart: %v", err)
+	}
+	if x.sess == sess || bytes.Equal(x.token, tok) {
+		t.Errorf("same session %d and token %q after reconnect", x.sess, x.token)
+	}
+
+	// Writes are not, but the next request reconnects.
+	s.restart()
+	if _, _, err := x.createRecord(9, &Document{Class: "Animal"}); err == nil {
+		t.Error("create after restart: expected error")
+	}
+	if _, err := x.size(); err != nil {
+		t.Errorf("size after failed create: %v", err)
+	}
+
+	x.close()
+	if _, err := x.size(); err != errClosed {
+		t.Errorf("size after close: got %v, want %v", err, errClosed)
+	}
+}
+
+func TestNoReconnect(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.close()
+	x := &Xx{}
+	if err := x.open(s.addr(), "test", "admin", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	defer x.close()
+	// Without Reconnect, or on a connection opened with openConn, a
+	// broken connection stays broken.
+	y, _ := dialFake(t, s)
+	y.Reconnect = true
+	defer y.close()
+
+	s.restart()
+	for _, x := range []*Xx{x, y} {
+		_, err := x.size()
+		if err == nil {
+			t.Fatal("size after restart: expected error")
+		}
+		if _, err2 := x.size(); err2 != err {
+			t.Errorf("second size after restart: got %v, want %v", err2, err)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package gorient
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Rid is a record id: the cluster a record lives in and its position
+// within that cluster.  Its text form is "#<cluster>:<position>".
+//
+// Rid implements encoding.TextMarshaler and TextUnmarshaler, so it
+// appears in JSON as a string ("#10:5") and may be used as a map key.
+type Rid struct {
+	Cluster  int16
+	Position int64
+}
+
+const (
+	clusterIdInvalid  = -1
+	clusterPosInvalid = -1
+)
+
+// NewRid is the id of a record that has not been assigned a place in the
+// database yet.
+var NewRid = Rid{clusterIdInvalid, clusterPosInvalid}
+
+// ParseRid parses the text form of a record id, with or without the
+// leading '#'.
+func ParseRid(s string) (Rid, error) {
+	t := strings.TrimPrefix(s, "#")
+	i := strings.IndexByte(t, ':')
+	if i < 0 {
+		return Rid{}, fmt.Errorf("gorient: invalid rid %q: missing ':'", s)
+	}
+	c, err := strconv.ParseInt(t[:i], 10, 16)
+	if err != nil {
+		return Rid{}, fmt.Errorf("gorient: invalid rid %q: bad cluster id", s)
+	}
+	p, err := strconv.ParseInt(t[i+1:], 10, 64)
+	if err != nil {
+		return Rid{}, fmt.Errorf("gorient: invalid rid %q: bad cluster position", s)
+	}
+	return Rid{int16(c), p}, nil
+}
+
+func (id Rid) String() string {
+	return string(id.appendText(make([]byte, 0, 24)))
+}
+
+func (id Rid) appendText(b []byte) []byte {
+	b = append(b, '#')
+	b = strconv.AppendInt(b, int64(id.Cluster), 10)
+	b = append(b, ':')
+	return strconv.AppendInt(b, id.Position, 10)
+}
+
+// IsValid reports whether id refers to a record, either stored or
+// pending.  The zero position is valid; only the -1 sentinel is not.
+func (id Rid) IsValid() bool {
+	return id.Position != clusterPosInvalid
+}
+
+// IsNew reports whether id belongs to a record that hasn't been stored.
+func (id Rid) IsNew() bool {
+	return id.Position < 0
+}
+
+// IsTemporary reports whether id is a placeholder handed out inside a
+// transaction, to be replaced by a real id on commit.
+func (id Rid) IsTemporary() bool {
+	return id.Cluster != clusterIdInvalid && id.Position < clusterPosInvalid
+}
+
+// IsPersistent reports whether id points at a stored record.
+func (id Rid) IsPersistent() bool {
+	return id.Cluster > clusterIdInvalid && id.Position > clusterPosInvalid
+}
+
+func (id Rid) MarshalText() ([]byte, error) {
+	return id.appendText(nil), nil
+}
+
+func (id *Rid) UnmarshalText(text []byte) error {
+	v, err := ParseRid(string(text))
+	if err != nil {
+		return err
+	}
+	*id = v
+	return nil
+}
@@ -0,0 +1,79 @@
+package gorient
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseRid(t *testing.T) {
+	good := map[string]Rid{
+		"#10:5":  {10, 5},
+		"10:5":   {10, 5},
+		"#0:0":   {0, 0},
+		"#-1:-1": NewRid,
+		"#3:-2":  {3, -2},
+	}
+	for s, want := range good {
+		id, err := ParseRid(s)
+		if err != nil || id != want {
+			t.Errorf("ParseRid(%q) = %v, %v; want %v", s, id, err, want)
+		}
+	}
+	for _, s := range []string{"", "#", "#10", "#10:", "#:5", "#a:5", "#99999:1"} {
+		if id, err := ParseRid(s); err == nil {
+			t.Errorf("ParseRid(%q) = %v; want error", s, id)
+		}
+	}
+}
+
+func TestRidString(t *testing.T) {
+	if s := (Rid{10, 5}).String(); s != "#10:5" {
+		t.Errorf("String() = %q", s)
+	}
+	if s := NewRid.String(); s != "#-1:-1" {
+		t.Errorf("String() = %q", s)
+	}
+}
+
+func TestRidState(t *testing.T) {
+	tests := []struct {
+		id                        Rid
+		valid, new, temp, persist bool
+	}{
+		{Rid{10, 5}, true, false, false, true},
+		{Rid{0, 0}, true, false, false, true},
+		{NewRid, false, true, false, false},
+		{Rid{10, -1}, false, true, false, false},
+		{Rid{10, -2}, true, true, true, false},
+		{Rid{-1, -2}, true, true, false, false},
+	}
+	for _, tt := range tests {
+		if tt.id.IsValid() != tt.valid || tt.id.IsNew() != tt.new ||
+			tt.id.IsTemporary() != tt.temp || tt.id.IsPersistent() != tt.persist {
+			t.Errorf("%v: valid=%v new=%v temp=%v persist=%v", tt.id,
+				tt.id.IsValid(), tt.id.IsNew(), tt.id.IsTemporary(), tt.id.IsPersistent())
+		}
+	}
+}
+
+func TestRidJSON(t *testing.T) {
+	in := map[Rid][]Rid{{1, 2}: {{10, 5}, {10, 6}}}
+	b, err := json.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `{"#1:2":["#10:5","#10:6"]}` {
+		t.Errorf("json.Marshal = %s", b)
+	}
+	var out map[Rid][]Rid
+	if err := json.Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 1 || len(out[Rid{1, 2}]) != 2 || out[Rid{1, 2}][1] != (Rid{10, 6}) {
+		t.Errorf("json.Unmarshal = %v", out)
+	}
+	var id Rid
+	if err := json.Unmarshal([]byte(`"#x:1"`), &id); err == nil {
+		t.Error("expected error unmarshaling bad rid")
+	}
+}
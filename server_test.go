@@ -0,0 +1,538 @@
+package gorient
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+// fakeServer speaks enough of the binary protocol to exercise the client
+// without a database.  It serves records from a fixed table, and answers
+// every command with the records in it.
+type fakeServer struct {
+	t     testing.TB
+	ln    net.Listener
+	proto int16
+
+	mu        sync.Mutex
+	records   map[Rid]string
+	nextSess  int32
+	tokens    map[string]bool // issued, and good across restarts
+	conns     map[net.Conn]bool
+	limit     int32 // of the last COMMAND
+	stallSize bool  // DB_SIZE hangs like a load from stallCluster
+}
+
+// Loading a record from stallCluster hangs the fake server, and one
+// from desyncCluster gets a response for the wrong session.
+const (
+	stallCluster  = 99
+	desyncCluster = 98
+)
+
+func newFakeServer(t testing.TB) *fakeServer {
+	return newFakeServerVersion(t, CURRENT_PROTOCOL_VERSION)
+}
+
+// newFakeServerVersion returns a fake server speaking protocol version
+// proto.
+func newFakeServerVersion(t testing.TB, proto int16) *fakeServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{
+		t:     t,
+		ln:    ln,
+		proto: proto,
+		records: map[Rid]string{
+			{9, 1}: `Animal@name:"Fido",age:3`,
+		},
+		tokens: make(map[string]bool),
+		conns:  make(map[net.Conn]bool),
+	}
+	go s.serve()
+	return s
+}
+
+func (s *fakeServer) addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *fakeServer) close() {
+	s.ln.Close()
+}
+
+// restart drops every client connection, as a server restart would.
+func (s *fakeServer) restart() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+		delete(s.conns, conn)
+	}
+}
+
+func (s *fakeServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+// srvConn is the server end of one client connection.
+type srvConn struct {
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+func (c *srvConn) read(v interface{}) {
+	if err := binary.Read(c.r, binary.BigEndian, v); err != nil {
+		panic(err)
+	}
+}
+
+func (c *srvConn) write(vs ...interface{}) {
+	for _, v := range vs {
+		switch v := v.(type) {
+		case string:
+			c.write(int32(len(v)))
+			c.w.WriteString(v)
+		case []byte:
+			c.write(int32(len(v)))
+			c.w.Write(v)
+		default:
+			binary.Write(c.w, binary.BigEndian, v)
+		}
+	}
+}
+
+func (c *srvConn) byte() (b byte)   { c.read(&b); return }
+func (c *srvConn) short() (n int16) { c.read(&n); return }
+func (c *srvConn) int() (n int32)   { c.read(&n); return }
+func (c *srvConn) long() (n int64)  { c.read(&n); return }
+func (c *srvConn) rid() Rid         { return Rid{c.short(), c.long()} }
+func (c *srvConn) string() string   { return string(c.bytes()) }
+func (c *srvConn) bytes() []byte {
+	n := c.int()
+	if n <= 0 {
+		return nil
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(c.r, b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func (s *fakeServer) handle(conn net.Conn) {
+	s.mu.Lock()
+	s.conns[conn] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	defer func() {
+		// The client hung up
+		recover()
+	}()
+
+	c := &srvConn{bufio.NewReader(conn), bufio.NewWriter(conn)}
+	c.write(s.proto)
+	c.w.Flush()
+
+	// The layouts of the client's protocol version, from DB_OPEN
+	p := protocols[0]
+
+	// Records are kept in the record string format, and converted for
+	// binary sessions.
+	binary := false
+	toClient := func(content string) string {
+		if !binary {
+			return content
+		}
+		var d Document
+		if err := Unmarshal([]byte(content), &d); err != nil {
+			panic(err)
+		}
+		b, err := MarshalBinary(&d)
+		if err != nil {
+			panic(err)
+		}
+		return string(b)
+	}
+	fromClient := func(content string) string {
+		if !binary {
+			return content
+		}
+		var d Document
+		if err := UnmarshalBinary([]byte(content), &d); err != nil {
+			s.t.Errorf("fake server: %v", err)
+			panic(err)
+		}
+		b, err := Marshal(&d)
+		if err != nil {
+			panic(err)
+		}
+		return string(b)
+	}
+
+	// With a token session each request carries the token, and each
+	// response header a renewed one (or nothing).  DB_COUNTRECORDS
+	// renews it.
+	var token string
+	var sess int32
+	header := func(status byte, renew bool) {
+		c.write(status, sess)
+		if token == "" {
+			return
+		}
+		if !renew {
+			c.write([]byte(nil))
+			return
+		}
+		s.mu.Lock()
+		token = fmt.Sprintf("token-%d-%d", sess, len(s.tokens))
+		s.tokens[token] = true
+		s.mu.Unlock()
+		c.write(token)
+	}
+
+	for {
+		cmd := Command(c.byte())
+		sess = c.int()
+		if token != "" {
+			t := c.string()
+			s.mu.Lock()
+			ok := s.tokens[t]
+			s.mu.Unlock()
+			if !ok || t != token {
+				s.t.Errorf("fake server: request with token %q, want %q", t, token)
+				return
+			}
+		}
+		switch cmd {
+		case DB_OPEN:
+			c.string() // driver name
+			c.string() // driver version
+			p, _ = negotiate(c.short())
+			c.string() // client id
+			if p.serializer {
+				binary = c.string() == SerializerBinary.name()
+			}
+			wantToken := p.tokenSession && c.byte() == 1
+			c.string() // database
+			c.string() // database type
+			c.string() // user
+			c.string() // password
+			s.mu.Lock()
+			s.nextSess++
+			id := s.nextSess
+			s.mu.Unlock()
+			c.write(byte(STATUS_OK), sess, id)
+			if wantToken {
+				token = fmt.Sprintf("token-%d", id)
+				s.mu.Lock()
+				s.tokens[token] = true
+				s.mu.Unlock()
+				c.write(token)
+			} else if p.tokenSession {
+				c.write([]byte(nil))
+			}
+			sess = id
+			c.write(int16(1), "default", int16(3))
+			if p.clusterType {
+				c.write("PHYSICAL", int16(0))
+			}
+			c.write(int32(-1))
+			if p.release {
+				c.write("1.3.0")
+			}
+
+		case DB_CLOSE:
+			return
+
+		case DB_SIZE, DB_COUNTRECORDS:
+			s.mu.Lock()
+			stall := cmd == DB_SIZE && s.stallSize
+			s.mu.Unlock()
+			if stall {
+				io.Copy(io.Discard, c.r)
+				return
+			}
+			header(STATUS_OK, cmd == DB_COUNTRECORDS)
+			s.mu.Lock()
+			c.write(int64(len(s.records)))
+			s.mu.Unlock()
+
+		case RECORD_LOAD:
+			rid := c.rid()
+			c.string() // fetch plan
+			c.byte()   // ignore cache
+			if p.tombstones {
+				c.byte()
+			}
+			if rid.Cluster == stallCluster {
+				// Send part of a response, then hang until the
+				// client gives up.
+				header(STATUS_OK, false)
+				c.write(byte(1))
+				c.w.Flush()
+				io.Copy(io.Discard, c.r)
+				return
+			}
+			if rid.Cluster == desyncCluster {
+				sess++
+			}
+			if rid.Cluster < 0 {
+				header(STATUS_ERROR, false)
+				c.write(byte(1), "com.orientechnologies.orient.core.exception.ODatabaseException", "Error on retrieving record "+rid.String(),
+					byte(1), "java.lang.IllegalArgumentException", "Cluster "+rid.String()[1:3]+" not found",
+					byte(0))
+				break
+			}
+			header(STATUS_OK, false)
+			s.mu.Lock()
+			content, ok := s.records[rid]
+			s.mu.Unlock()
+			if ok && p.loadTypeFirst {
+				c.write(byte(1), byte('d'), int32(1), toClient(content))
+			} else if ok {
+				c.write(byte(1), toClient(content), int32(1), byte('d'))
+			}
+			c.write(byte(0))
+
+		case RECORD_CREATE:
+			if p.dataSegment {
+				c.int()
+			}
+			cluster := c.short()
+			content := fromClient(c.string())
+			c.byte() // record type
+			c.byte() // mode
+			s.mu.Lock()
+			rid := Rid{cluster, int64(len(s.records)) + 100}
+			s.records[rid] = content
+			s.mu.Unlock()
+			header(STATUS_OK, false)
+			if p.createClusterId {
+				c.write(rid.Cluster)
+			}
+			c.write(rid.Position, int32(0))
+			if p.collectionChanges {
+				c.write(int32(0))
+			}
+
+		case RECORD_UPDATE:
+			rid := c.rid()
+			if p.updateContent {
+				c.byte()
+			}
+			content := fromClient(c.string())
+			ver := c.int()
+			c.byte() // record type
+			c.byte() // mode
+			s.mu.Lock()
+			s.records[rid] = content
+			s.mu.Unlock()
+			// Tell the client about the change, as if it were
+			// another client's.
+			c.write(byte(PUSH_DATA), int32(pushSession), byte(PUSH_RECORD))
+			c.write(int16(0), byte('d'), rid, ver+1, toClient(content))
+			header(STATUS_OK, false)
+			c.write(ver + 1)
+			if p.collectionChanges {
+				c.write(int32(0))
+			}
+
+		case COMMAND:
+			c.byte()   // mode
+			c.int()    // payload length
+			c.string() // class
+			text := c.string()
+			limit := c.int()
+			plan := c.string()
+			c.bytes() // params
+			if text == "push config" {
+				c.write(byte(PUSH_DATA), int32(pushSession), byte(PUSH_DISTRIB_CONFIG))
+				c.write(toClient(`members:[(name:"node1"),(name:"node2")]`))
+			}
+			s.mu.Lock()
+			s.limit = limit
+			header(STATUS_OK, false)
+			c.write(byte('l'), int32(len(s.records)))
+			for rid, content := range s.records {
+				c.write(int16(0), byte('d'), rid, int32(1), toClient(content))
+			}
+			if p.commandPrefetch {
+				// Any fetch plan prefetches #9:1.
+				if plan != "" {
+					c.write(byte(2), int16(0), byte('d'), Rid{9, 1}, int32(1), toClient(s.records[Rid{9, 1}]))
+				}
+				c.write(byte(0))
+			}
+			s.mu.Unlock()
+
+		default:
+			s.t.Errorf("fake server: unexpected command %d", cmd)
+			return
+		}
+		c.w.Flush()
+	}
+}
+
+// countConn counts the reads and writes made on a connection, each of
+// which is a system call.
+type countConn struct {
+	net.Conn
+	reads, writes int
+}
+
+func (c *countConn) Read(p []byte) (int, error) {
+	c.reads++
+	return c.Conn.Read(p)
+}
+
+func (c *countConn) Write(p []byte) (int, error) {
+	c.writes++
+	return c.Conn.Write(p)
+}
+
+// dialFake opens a client on s, counting its system calls.
+func dialFake(t testing.TB, s *fakeServer) (*Xx, *countConn) {
+	conn, err := net.Dial("tcp", s.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := &countConn{Conn: conn}
+	x := &Xx{}
+	if err := x.openConn(cc, "test", "admin", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	return x, cc
+}
+
+func TestFakeServer(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.close()
+	x, cc := dialFake(t, s)
+	defer x.close()
+
+	cc.reads, cc.writes = 0, 0
+	rec, _, err := x.loadRecord(Rid{9, 1}, "")
+	if d, ok := rec.Value.(*Document); err != nil || !ok || d.Fields["name"] != "Fido" || rec.Rid != (Rid{9, 1}) {
+		t.Errorf("loadRecord: got %v, %v", rec, err)
+	}
+	if cc.writes != 1 {
+		t.Errorf("loadRecord made %d writes, want 1", cc.writes)
+	}
+
+	rid, ver, err := x.createRecord(9, &Document{Class: "Animal", Fields: map[string]interface{}{"name": "Pip"}})
+	if ver != 0 || err != nil {
+		t.Errorf("createRecord: version %d, %v", ver, err)
+	}
+	if ver, err := x.updateRecord(rid, &animal{Class: "Animal", Name: "Pip", Age: 2}, 0); ver != 1 || err != nil {
+		t.Errorf("updateRecord: version %d, %v", ver, err)
+	}
+	rec, _, err = x.loadRecord(rid, "")
+	if d, ok := rec.Value.(*Document); err != nil || !ok || d.Fields["Age"] != int64(2) {
+		t.Errorf("loadRecord after update: got %v, %v", rec, err)
+	}
+	if n, err := x.size(); n != 2 || err != nil {
+		t.Errorf("size: got %d, %v", n, err)
+	}
+
+	rs, err := x.command("select from Animal", "q", 's', -1, "")
+	if err != nil || len(rs.Records) != 2 {
+		t.Fatalf("command: got %v, %v", rs, err)
+	}
+	rs, err = x.command("select from Animal", "q", 's', -1, "*:-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, ok := rs.Prefetch[Rid{9, 1}].Value.(*Document); !ok || d.Fields["name"] != "Fido" {
+		t.Errorf("command with fetch plan: prefetched %v", rs.Prefetch)
+	}
+
+	// The limit is sent as given; the original client always sent 2.
+	if _, err := x.command("select from Animal", "q", 's', 5, ""); err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	if s.limit != 5 {
+		t.Errorf("command sent limit %d, want 5", s.limit)
+	}
+	s.mu.Unlock()
+
+	// Encoding errors are caught before anything is sent.
+	if _, _, err := x.createRecord(9, map[string]interface{}{"f": make(chan int)}); err == nil {
+		t.Error("createRecord: expected error")
+	}
+	if _, err := x.size(); err != nil {
+		t.Errorf("size after encoding error: %v", err)
+	}
+
+	// A server error leaves the connection usable.
+	if _, _, err := x.loadRecord(Rid{-5, 0}, ""); err == nil {
+		t.Error("expected server error")
+	} else if e, ok := err.(*ServerError); !ok || len(e.Exceptions) != 2 {
+		t.Errorf("got %#v", err)
+	}
+	if _, err := x.size(); err != nil {
+		t.Errorf("size after server error: %v", err)
+	}
+
+	// A response for the wrong session breaks the connection.
+	if _, _, err := x.loadRecord(Rid{desyncCluster, 0}, ""); !errors.Is(err, ErrDesync) {
+		t.Errorf("loadRecord with bad session: got %v", err)
+	}
+	if _, err := x.size(); !errors.Is(err, ErrDesync) {
+		t.Errorf("size after desync: got %v", err)
+	}
+
+	x.close()
+	if _, err := x.size(); !errors.Is(err, ErrDesync) {
+		t.Errorf("size after close: got %v", err)
+	}
+}
+
+func BenchmarkLoadRecord(b *testing.B) {
+	s := newFakeServer(b)
+	defer s.close()
+	x, cc := dialFake(b, s)
+	defer x.close()
+
+	cc.reads, cc.writes = 0, 0
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		x.loadRecord(Rid{9, 1}, "")
+	}
+	b.ReportMetric(float64(cc.writes)/float64(b.N), "writes/op")
+	b.ReportMetric(float64(cc.reads)/float64(b.N), "reads/op")
+}
+
+func BenchmarkCommand(b *testing.B) {
+	s := newFakeServer(b)
+	defer s.close()
+	x, cc := dialFake(b, s)
+	defer x.close()
+
+	cc.reads, cc.writes = 0, 0
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		x.command("select from Animal", "q", 's', -1, "")
+	}
+	b.ReportMetric(float64(cc.writes)/float64(b.N), "writes/op")
+	b.ReportMetric(float64(cc.reads)/float64(b.N), "reads/op")
+}
@@ -0,0 +1,118 @@
+package gorient
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	r "reflect"
+	"time"
+)
+
+// An Encoder writes documents in the record string format to an output
+// stream, without building them in memory first.
+type Encoder struct {
+	// Location is the database server's time zone, where dates are
+	// written as midnight.  Nil means UTC.
+	Location *time.Location
+
+	w  io.Writer
+	bw *bufio.Writer
+}
+
+// NewEncoder returns an encoder that writes to w.
+//
+// If w is a *bufio.Writer the encoder writes into its buffer, and it is
+// up to the caller to flush it.  Otherwise the encoder buffers its own
+// output, and flushes it at the end of each call to Encode.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode writes the encoding of v, as described for Marshal.
+//
+// An error can leave part of the encoding written.  Callers that can't
+// allow that should check v with EncodedLen first.
+func (enc *Encoder) Encode(v interface{}) error {
+	if bw, ok := enc.w.(*bufio.Writer); ok {
+		e := &encodeState{encWriter: bw, loc: enc.Location}
+		return e.marshal(v)
+	}
+
+	if enc.bw == nil {
+		enc.bw = bufio.NewWriter(enc.w)
+	}
+	e := &encodeState{encWriter: enc.bw, loc: enc.Location}
+	err := e.marshal(v)
+	if ferr := enc.bw.Flush(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+// A Decoder reads documents in the record string format from an input
+// stream, one per line.  A document can't span lines: a newline in a
+// string must be escaped as \n, as Marshal and Encoder write it, and an
+// unescaped one ends the document, leaving the string unterminated.
+//
+// The decoder reuses its read buffer, and remembers field names so that
+// documents of the same shape share their name strings.  Decoding into
+// the same *Document each time also reuses its storage, so that large
+// streams can be processed with little allocation.
+type Decoder struct {
+	// Location is the database server's time zone, where dates are
+	// midnight, as for UnmarshalInLocation.  Nil means UTC.
+	Location *time.Location
+
+	r     *bufio.Reader
+	buf   []byte
+	names nameCache
+}
+
+// NewDecoder returns a decoder that reads from rd.
+func NewDecoder(rd io.Reader) *Decoder {
+	return &Decoder{
+		r:     bufio.NewReader(rd),
+		names: make(nameCache),
+	}
+}
+
+// Decode reads the next document and stores it in v, as Unmarshal does.
+// Blank lines are skipped.  At the end of the input it returns io.EOF.
+func (dec *Decoder) Decode(v interface{}) error {
+	rv := r.ValueOf(v)
+	if rv.Kind() != r.Ptr || rv.IsNil() {
+		return &InvalidUnmarshalError{r.TypeOf(v)}
+	}
+	for {
+		line, err := dec.readLine()
+		if err != nil {
+			return err
+		}
+		if len(line) > 0 {
+			return unmarshal(decode, line, rv, dec.names, dec.Location)
+		}
+	}
+}
+
+// readLine returns the next line of input, without its line ending.  The
+// line is only valid until the next call.
+func (dec *Decoder) readLine() ([]byte, error) {
+	line, err := dec.r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		// Longer than the bufio.Reader's buffer; gather it in ours.
+		dec.buf = append(dec.buf[:0], line...)
+		for err == bufio.ErrBufferFull {
+			line, err = dec.r.ReadSlice('\n')
+			dec.buf = append(dec.buf, line...)
+		}
+		line = dec.buf
+	}
+	if err == io.EOF && len(line) > 0 {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	return bytes.TrimSuffix(line, []byte("\r")), nil
+}
@@ -0,0 +1,201 @@
+package gorient
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEncoder(t *testing.T) {
+	docs := []interface{}{
+		parse(testrec),
+		&Document{Class: "Animal", Fields: map[string]interface{}{"name": "Fido"}},
+		[]interface{}{int32(1), "two", Set{Rid{3, 4}}},
+	}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	for _, v := range docs {
+		want, err := Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf.Reset()
+		if err := enc.Encode(v); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != string(want) {
+			t.Errorf("Encode: got %s\nwant %s", buf.Bytes(), want)
+		}
+		if n, err := EncodedLen(v); n != len(want) || err != nil {
+			t.Errorf("EncodedLen = %d, %v; want %d", n, err, len(want))
+		}
+	}
+
+	// Writing into a caller's bufio.Writer leaves flushing to the caller.
+	buf.Reset()
+	bw := bufio.NewWriter(&buf)
+	if err := NewEncoder(bw).Encode(docs[1]); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Error("Encode flushed the caller's bufio.Writer")
+	}
+	bw.Flush()
+	if buf.String() != `Animal@name:"Fido"` {
+		t.Errorf("got %s", buf.Bytes())
+	}
+}
+
+type failWriter struct{}
+
+func (failWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestEncoderErrors(t *testing.T) {
+	if err := NewEncoder(failWriter{}).Encode(parse(testrec)); err == nil || err.Error() != "write failed" {
+		t.Errorf("got %v, want write error", err)
+	}
+	if err := NewEncoder(io.Discard).Encode(make(chan int)); err == nil {
+		t.Error("expected UnsupportedTypeError")
+	}
+	if _, err := EncodedLen(map[string]interface{}{"f": make(chan int)}); err == nil {
+		t.Error("EncodedLen: expected UnsupportedTypeError")
+	}
+}
+
+// The record content written to the connection is the length-prefixed
+// encoding.
+func TestWriteRecord(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	x := &Xx{conn: client, w: bufio.NewWriter(client)}
+
+	d := parse(testrec)
+	want, _ := Marshal(d)
+	got := make(chan []byte)
+	go func() {
+		var n int32
+		binary.Read(server, binary.BigEndian, &n)
+		b := make([]byte, n)
+		io.ReadFull(server, b)
+		got <- b
+		server.Close()
+	}()
+	n, _ := EncodedLen(d)
+	x.writeRecord(d, n)
+	x.endReq()
+	if b := <-got; string(b) != string(want) {
+		t.Errorf("got %s\nwant %s", b, want)
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	in := testrec + "\n" +
+		`Animal@name:"Fido",age:3` + "\r\n" +
+		"\n" +
+		`Animal@name:"Pip"` + "\n" +
+		`name:"Rex",age:x` + "\n" +
+		`Animal@tags:[1,2` + "\n" +
+		`Animal@name:"Last",age:` + strings.Repeat("9", 5000) + `l`
+
+	dec := NewDecoder(strings.NewReader(in))
+	var d Document
+	if err := dec.Decode(&d); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&d, parse(testrec)) {
+		t.Errorf("got %v", &d)
+	}
+
+	var a animal
+	if err := dec.Decode(&a); err != nil || a != (animal{"Animal", "Fido", 3}) {
+		t.Errorf("got %v, %v", a, err)
+	}
+
+	// Decoding into the same Document replaces its fields.
+	if err := dec.Decode(&d); err != nil {
+		t.Fatal(err)
+	}
+	if d.Class != "Animal" || len(d.Fields) != 1 || !reflect.DeepEqual(d.order, []string{"name"}) {
+		t.Errorf("got %v %v", &d, d.order)
+	}
+
+	if err := dec.Decode(&d); err == nil {
+		t.Error("expected syntax error")
+	} else if _, ok := err.(*SyntaxError); !ok {
+		t.Errorf("got %v", err)
+	}
+
+	// A truncated line is an error, not a wait for more.
+	if err := dec.Decode(&d); err == nil {
+		t.Error("truncated line: expected syntax error")
+	} else if _, ok := err.(*SyntaxError); !ok {
+		t.Errorf("truncated line: got %v", err)
+	}
+
+	// A line longer than the read buffer, ending at EOF; its 5000 digit
+	// long is out of range.
+	if err := dec.Decode(&d); err == nil {
+		t.Error("expected syntax error")
+	} else if e, ok := err.(*SyntaxError); !ok || e.Offset != 23 {
+		t.Errorf("got %v", err)
+	}
+
+	if err := dec.Decode(&d); err != io.EOF {
+		t.Errorf("got %v, want EOF", err)
+	}
+	if err := dec.Decode(d); err == nil {
+		t.Error("expected InvalidUnmarshalError")
+	}
+}
+
+func TestDecoderLongLine(t *testing.T) {
+	name := strings.Repeat("x", 10000)
+	in := `Animal@name:"` + name + `"` + "\n" + `Animal@name:"short"`
+	dec := NewDecoder(strings.NewReader(in))
+	var a animal
+	if err := dec.Decode(&a); err != nil || a.Name != name {
+		t.Errorf("got %d bytes, %v", len(a.Name), err)
+	}
+	if err := dec.Decode(&a); err != nil || a.Name != "short" {
+		t.Errorf("got %q, %v", a.Name, err)
+	}
+}
+
+func TestDecoderNewlineInString(t *testing.T) {
+	b, err := Marshal(&animal{Class: "Animal", Name: "two\nlines"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := string(b) + "\n" + `Animal@name:"two` + "\n" + `lines"`
+	dec := NewDecoder(strings.NewReader(in))
+	var a animal
+	if err := dec.Decode(&a); err != nil || a.Name != "two\nlines" {
+		t.Errorf("escaped newline: got %q, %v", a.Name, err)
+	}
+	// Unescaped, it splits the document in two.
+	if err := dec.Decode(&a); err == nil {
+		t.Error("unescaped newline: expected syntax error")
+	} else if _, ok := err.(*SyntaxError); !ok {
+		t.Errorf("unescaped newline: got %v", err)
+	}
+}
+
+func BenchmarkDecoder(b *testing.B) {
+	in := []byte(strings.Repeat(testrec+"\n", 100))
+	b.SetBytes(int64(len(in)))
+	var d Document
+	for i := 0; i < b.N; i++ {
+		dec := NewDecoder(bytes.NewReader(in))
+		for dec.Decode(&d) == nil {
+		}
+	}
+}